@@ -0,0 +1,57 @@
+package rkasynq
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+)
+
+// SetBaggage returns context with baggage member of key and value.
+//
+// Value should be a valid W3C baggage value, otherwise error is returned.
+// Baggage is propagated into tasks created with NewTracedTask from returned context. asynq.Client doesn't
+// propagate it by itself, so child tasks enqueued from handler must be created with NewTracedTask, or producers
+// which call it, for example Compressor.NewTask, with context of handler.
+func SetBaggage(ctx context.Context, key, value string) (context.Context, error) {
+	member, err := baggage.NewMember(key, value)
+	if err != nil {
+		return ctx, err
+	}
+
+	bag, err := baggage.FromContext(ctx).SetMember(member)
+	if err != nil {
+		return ctx, err
+	}
+
+	return baggage.ContextWithBaggage(ctx, bag), nil
+}
+
+// GetBaggage returns value of baggage member, empty string if missing
+func GetBaggage(ctx context.Context, key string) string {
+	return baggage.FromContext(ctx).Member(key).Value()
+}
+
+// GetAllBaggage returns all baggage members as map
+func GetAllBaggage(ctx context.Context) map[string]string {
+	res := make(map[string]string)
+
+	for _, m := range baggage.FromContext(ctx).Members() {
+		res[m.Key()] = m.Value()
+	}
+
+	return res
+}
+
+// baggageAttributes returns span attributes of selected baggage keys
+func baggageAttributes(ctx context.Context, keys []string) []attribute.KeyValue {
+	res := make([]attribute.KeyValue, 0)
+	bag := baggage.FromContext(ctx)
+
+	for _, k := range keys {
+		if m := bag.Member(k); len(m.Key()) > 0 {
+			res = append(res, attribute.String("baggage."+k, m.Value()))
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,76 @@
+package rkasynq
+
+import (
+	"context"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+func TestBaggage(t *testing.T) {
+	ctx, err := SetBaggage(context.Background(), "tenant", "acme")
+	assert.Nil(t, err)
+	ctx, err = SetBaggage(ctx, "origin", "web")
+	assert.Nil(t, err)
+
+	assert.Equal(t, "acme", GetBaggage(ctx, "tenant"))
+	assert.Empty(t, GetBaggage(ctx, "missing"))
+	assert.Equal(t, map[string]string{"tenant": "acme", "origin": "web"}, GetAllBaggage(ctx))
+
+	// invalid key
+	res, err := SetBaggage(ctx, "bad key", "v")
+	assert.NotNil(t, err)
+	assert.Equal(t, ctx, res)
+}
+
+func TestBaggage_RoundTrip(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	RegisterSharedTrace("baggage-test", sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)), nil)
+
+	mid, err := NewJaegerMid([]byte(`
+asynq:
+  trace:
+    enabled: true
+    baggageAttributes: [tenant]
+    shared:
+      enabled: true
+      name: baggage-test
+`))
+	assert.Nil(t, err)
+
+	ctx, err := SetBaggage(context.Background(), "tenant", "acme")
+	assert.Nil(t, err)
+	ctx, err = SetBaggage(ctx, "origin", "web")
+	assert.Nil(t, err)
+
+	task, err := NewTracedTask(ctx, "baggage:parent", []byte(`{"id":1}`))
+	assert.Nil(t, err)
+
+	var child *asynq.Task
+	h := mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		var err error
+		child, err = NewTracedTask(ctx, "baggage:child", nil)
+		return err
+	}))
+	assert.Nil(t, h.ProcessTask(context.Background(), task))
+
+	// baggage of child task is extracted by consumer of child
+	var childBaggage map[string]string
+	h = mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		childBaggage = GetAllBaggage(ctx)
+		return nil
+	}))
+	assert.Nil(t, h.ProcessTask(context.Background(), child))
+	assert.Equal(t, map[string]string{"tenant": "acme", "origin": "web"}, childBaggage)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	for _, span := range spans {
+		// only selected keys are copied onto spans
+		assert.Equal(t, "acme", spanAttribute(span, "baggage.tenant"))
+		assert.Empty(t, spanAttribute(span, "baggage.origin"))
+	}
+	assert.Equal(t, spans[0].SpanContext().TraceID(), spans[1].SpanContext().TraceID())
+}
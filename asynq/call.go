@@ -0,0 +1,156 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+const (
+	defaultCallPollInterval = 100 * time.Millisecond
+	defaultCallRetention    = 10 * time.Minute
+)
+
+// ErrTaskArchived is returned by Call if task is archived after retries exhausted
+var ErrTaskArchived = errors.New("task archived")
+
+// callResultMarker marks result written by WriteResult, so that other JSON results are returned as they are
+const callResultMarker = 1
+
+// callResult is written by WriteResult
+type callResult struct {
+	RkCall  int    `json:"rkCall"`
+	TraceId string `json:"traceId"`
+	Data    []byte `json:"data"`
+}
+
+// NewCaller create Caller which enqueues tasks and waits for results with the same redis as asynq.Server.
+func NewCaller(redisOpt asynq.RedisConnOpt) *Caller {
+	return &Caller{
+		client:       asynq.NewClient(redisOpt),
+		inspector:    asynq.NewInspector(redisOpt),
+		pollInterval: defaultCallPollInterval,
+	}
+}
+
+// Caller enqueue task and wait for result written by handler with WriteResult
+type Caller struct {
+	client       *asynq.Client
+	inspector    *asynq.Inspector
+	pollInterval time.Duration
+}
+
+// Call enqueue task with trace injected and wait until task is completed or archived, or ctx is done.
+//
+// Options of task are not kept since trace is injected into a new task, pass them with opts instead.
+// Completed task needs to be retained in order to read result, retention of 10 minutes is used if
+// asynq.Retention is not provided.
+func (c *Caller) Call(ctx context.Context, task *asynq.Task, opts ...asynq.Option) ([]byte, error) {
+	ctx, span := GetTracer(ctx).Start(ctx, fmt.Sprintf("call %s", task.Type()),
+		oteltrace.WithSpanKind(oteltrace.SpanKindClient),
+		oteltrace.WithAttributes(attribute.String("asynq.task.type", task.Type())))
+	defer span.End()
+
+	res, err := c.call(ctx, span, task, opts...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetStatus(codes.Ok, "success")
+	}
+
+	return res, err
+}
+
+func (c *Caller) call(ctx context.Context, span oteltrace.Span, task *asynq.Task, opts ...asynq.Option) ([]byte, error) {
+	hasRetention := false
+	for _, opt := range opts {
+		hasRetention = hasRetention || opt.Type() == asynq.RetentionOpt
+	}
+	if !hasRetention {
+		opts = append(opts, asynq.Retention(defaultCallRetention))
+	}
+
+	traced, err := NewTracedTask(ctx, task.Type(), task.Payload(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := c.client.EnqueueContext(ctx, traced)
+	if err != nil {
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.String("asynq.task.id", info.ID),
+		attribute.String("asynq.queue", info.Queue))
+
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("wait for task %s: %w", info.ID, ctx.Err())
+		case <-ticker.C:
+		}
+
+		info, err = c.inspector.GetTaskInfo(info.Queue, info.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		switch info.State {
+		case asynq.TaskStateCompleted:
+			return readCallResult(span, info.Result), nil
+		case asynq.TaskStateArchived:
+			return nil, fmt.Errorf("%w: %s: %s", ErrTaskArchived, info.ID, info.LastErr)
+		}
+	}
+}
+
+// Close client and inspector
+func (c *Caller) Close() error {
+	if err := c.client.Close(); err != nil {
+		return err
+	}
+
+	return c.inspector.Close()
+}
+
+func readCallResult(span oteltrace.Span, raw []byte) []byte {
+	res := &callResult{}
+	if err := json.Unmarshal(raw, res); err != nil || res.RkCall != callResultMarker {
+		// result is not written by WriteResult
+		return raw
+	}
+
+	span.SetAttributes(attribute.String("asynq.result.traceId", res.TraceId))
+	return res.Data
+}
+
+// WriteResult write result of task along with trace ID, which is returned by Caller.Call
+func WriteResult(ctx context.Context, t *asynq.Task, data []byte) error {
+	writer := GetResultWriter(ctx, t)
+	if writer == nil {
+		return errors.New("result writer is not available")
+	}
+
+	raw, err := json.Marshal(&callResult{
+		RkCall:  callResultMarker,
+		TraceId: GetTraceId(ctx),
+		Data:    data,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(raw)
+	return err
+}
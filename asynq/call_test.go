@@ -0,0 +1,101 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+	"time"
+)
+
+func TestReadCallResult(t *testing.T) {
+	span := GetSpan(context.Background())
+
+	raw, err := json.Marshal(&callResult{
+		RkCall:  callResultMarker,
+		TraceId: "trace",
+		Data:    []byte("data"),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("data"), readCallResult(span, raw))
+
+	// results written with task's ResultWriter directly are returned as they are
+	for _, v := range []string{`{"ok":true}`, `{"traceId":"t","data":"ZGF0YQ=="}`, `plain`, `[1]`} {
+		assert.Equal(t, []byte(v), readCallResult(span, []byte(v)))
+	}
+}
+
+func TestCaller_Call(t *testing.T) {
+	_, opt, _ := newTestRedis(t)
+
+	recorder := tracetest.NewSpanRecorder()
+	RegisterSharedTrace("call-test", sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)), nil)
+
+	mid, err := NewJaegerMid([]byte(`
+asynq:
+  trace:
+    enabled: true
+    shared:
+      enabled: true
+      name: call-test
+`))
+	assert.Nil(t, err)
+
+	release := make(chan struct{})
+	mux := asynq.NewServeMux()
+	mux.Use(mid)
+	mux.HandleFunc("call:echo", func(ctx context.Context, t *asynq.Task) error {
+		return WriteResult(ctx, t, []byte("pong"))
+	})
+	mux.HandleFunc("call:fail", func(ctx context.Context, t *asynq.Task) error {
+		return errors.New("boom")
+	})
+	mux.HandleFunc("call:block", func(ctx context.Context, t *asynq.Task) error {
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return nil
+	})
+
+	srv := asynq.NewServer(opt, asynq.Config{
+		Concurrency:     2,
+		ShutdownTimeout: time.Second,
+		LogLevel:        asynq.FatalLevel,
+	})
+	assert.Nil(t, srv.Start(mux))
+	defer srv.Shutdown()
+	defer close(release)
+
+	caller := NewCaller(opt)
+	caller.pollInterval = 10 * time.Millisecond
+	defer caller.Close()
+
+	// result written by handler is returned
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := caller.Call(ctx, asynq.NewTask("call:echo", []byte(`{}`)))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("pong"), res)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "call:echo", spans[0].Name())
+
+	// handler error archives task
+	res, err = caller.Call(ctx, asynq.NewTask("call:fail", []byte(`{}`)), asynq.MaxRetry(0))
+	assert.True(t, errors.Is(err, ErrTaskArchived))
+	assert.Contains(t, err.Error(), "boom")
+	assert.Nil(t, res)
+
+	// caller stops waiting once ctx is done
+	timeoutCtx, timeoutCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer timeoutCancel()
+	res, err = caller.Call(timeoutCtx, asynq.NewTask("call:block", []byte(`{}`)))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Nil(t, res)
+}
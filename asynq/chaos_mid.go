@@ -0,0 +1,222 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	// ChaosEnvGuard must be set to ChaosEnvGuardValue in addition to enabled in config,
+	// so that chaos could not be enabled by config alone.
+	ChaosEnvGuard      = "RK_ASYNQ_CHAOS"
+	ChaosEnvGuardValue = "i-know-what-i-am-doing"
+
+	ChaosFaultLatency   = "latency"
+	ChaosFaultPanic     = "panic"
+	ChaosFaultSkipRetry = "skip_retry"
+	ChaosFaultError     = "error"
+)
+
+// ErrChaos is matched by errors.Is with every error injected by ChaosMiddleware,
+// the one of skipRetry fault matches asynq.SkipRetry as well
+var ErrChaos = errors.New("chaos injected error")
+
+// chaosSkipRetryError is injected by skipRetry fault
+type chaosSkipRetryError struct{}
+
+// Error returns message of ErrChaos and asynq.SkipRetry
+func (e *chaosSkipRetryError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrChaos, asynq.SkipRetry)
+}
+
+// Is returns true for both ErrChaos and asynq.SkipRetry
+func (e *chaosSkipRetryError) Is(target error) bool {
+	return target == ErrChaos || target == asynq.SkipRetry
+}
+
+// ChaosConfig defines faults injected per task type or pattern, for testing only.
+//
+// Pattern follows path.Match, probabilities are between 0 and 1. Latency is rolled independently and
+// injected before handler runs. Panic, skipRetry and error are exclusive, they are picked by a single roll,
+// so sum of their probabilities must not exceed 1 and each of them is injected with its own probability.
+// Middleware is disabled unless environment variable RK_ASYNQ_CHAOS is set to i-know-what-i-am-doing as well.
+//
+// Example:
+//
+//	asynq:
+//	  chaos:
+//	    enabled: true
+//	    tasks:
+//	      email:*:
+//	        latency:
+//	          probability: 0.2
+//	          duration: 3s
+//	        error:
+//	          probability: 0.1
+//	        panic:
+//	          probability: 0.01
+//	        skipRetry:
+//	          probability: 0.01
+type ChaosConfig struct {
+	Asynq struct {
+		Chaos struct {
+			Enabled bool `yaml:"enabled" json:"enabled"`
+			Tasks   map[string]struct {
+				Latency struct {
+					Probability float64 `yaml:"probability" json:"probability"`
+					Duration    string  `yaml:"duration" json:"duration"`
+				} `yaml:"latency" json:"latency"`
+				Error struct {
+					Probability float64 `yaml:"probability" json:"probability"`
+				} `yaml:"error" json:"error"`
+				Panic struct {
+					Probability float64 `yaml:"probability" json:"probability"`
+				} `yaml:"panic" json:"panic"`
+				SkipRetry struct {
+					Probability float64 `yaml:"probability" json:"probability"`
+				} `yaml:"skipRetry" json:"skipRetry"`
+			} `yaml:"tasks" json:"tasks"`
+		} `yaml:"chaos" json:"chaos"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+type chaosFaults struct {
+	latency              time.Duration
+	latencyProbability   float64
+	errorProbability     float64
+	panicProbability     float64
+	skipRetryProbability float64
+}
+
+// NewChaosMid create middleware which injects faults in order to verify handlers and retry policies.
+//
+// Middleware should be placed after TraceMiddleware so that injected faults are tagged on span.
+// Middleware passes every task through unless both enabled in config and environment guard are set.
+func NewChaosMid(raw []byte) (asynq.MiddlewareFunc, error) {
+	conf := &ChaosConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	mid := &ChaosMiddleware{
+		enabled: conf.Asynq.Chaos.Enabled && os.Getenv(ChaosEnvGuard) == ChaosEnvGuardValue,
+		faults:  map[string]*chaosFaults{},
+	}
+
+	for k, v := range conf.Asynq.Chaos.Tasks {
+		if _, err := path.Match(k, ""); err != nil {
+			return nil, fmt.Errorf("invalid task pattern %s: %v", k, err)
+		}
+
+		faults := &chaosFaults{
+			latencyProbability:   v.Latency.Probability,
+			errorProbability:     v.Error.Probability,
+			panicProbability:     v.Panic.Probability,
+			skipRetryProbability: v.SkipRetry.Probability,
+		}
+
+		if len(v.Latency.Duration) > 0 {
+			d, err := time.ParseDuration(v.Latency.Duration)
+			if err != nil {
+				return nil, fmt.Errorf("invalid chaos latency of %s: %v", k, err)
+			}
+			faults.latency = d
+		}
+
+		for _, p := range []float64{faults.latencyProbability, faults.errorProbability, faults.panicProbability, faults.skipRetryProbability} {
+			if p < 0 || p > 1 {
+				return nil, fmt.Errorf("invalid chaos probability of %s: %v", k, p)
+			}
+		}
+
+		if sum := faults.panicProbability + faults.skipRetryProbability + faults.errorProbability; sum > 1 {
+			return nil, fmt.Errorf("sum of chaos panic, skipRetry and error probability of %s exceeds 1: %v", k, sum)
+		}
+
+		mid.faults[k] = faults
+		mid.patterns = append(mid.patterns, k)
+	}
+
+	// longer pattern is more specific
+	sort.Slice(mid.patterns, func(i, j int) bool {
+		return len(mid.patterns[i]) > len(mid.patterns[j])
+	})
+
+	return mid.Middleware, nil
+}
+
+type ChaosMiddleware struct {
+	enabled  bool
+	faults   map[string]*chaosFaults
+	patterns []string
+}
+
+func (m *ChaosMiddleware) Middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if !m.enabled {
+			return h.ProcessTask(ctx, t)
+		}
+
+		pattern, ok := matchTaskPattern(m.patterns, t.Type())
+		if !ok {
+			return h.ProcessTask(ctx, t)
+		}
+
+		faults := m.faults[pattern]
+
+		if faults.latency > 0 && roll(faults.latencyProbability) {
+			tagChaos(ctx, t, ChaosFaultLatency, attribute.String("asynq.chaos.latency", faults.latency.String()))
+
+			timer := time.NewTimer(faults.latency)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("%w: %w", ErrChaos, ctx.Err())
+			case <-timer.C:
+			}
+		}
+
+		// exclusive faults take cumulative ranges of a single roll
+		switch r := rand.Float64(); {
+		case r < faults.panicProbability:
+			tagChaos(ctx, t, ChaosFaultPanic)
+			panic(fmt.Sprintf("chaos injected panic of %s", t.Type()))
+		case r < faults.panicProbability+faults.skipRetryProbability:
+			tagChaos(ctx, t, ChaosFaultSkipRetry)
+			return &chaosSkipRetryError{}
+		case r < faults.panicProbability+faults.skipRetryProbability+faults.errorProbability:
+			tagChaos(ctx, t, ChaosFaultError)
+			return ErrChaos
+		}
+
+		return h.ProcessTask(ctx, t)
+	})
+}
+
+// roll returns true with probability p
+func roll(p float64) bool {
+	return p > 0 && rand.Float64() < p
+}
+
+// tagChaos tag injected fault on span and count it
+func tagChaos(ctx context.Context, t *asynq.Task, fault string, attrs ...attribute.KeyValue) {
+	attrs = append(attrs,
+		attribute.String("asynq.task.type", t.Type()),
+		attribute.String("asynq.chaos.fault", fault))
+
+	span := GetSpan(ctx)
+	span.SetAttributes(attribute.Bool("asynq.chaos.injected", true))
+	span.AddEvent("chaos_injected", oteltrace.WithAttributes(attrs...))
+
+	incCounter("chaos_injected_total", []string{"type", "fault"}, t.Type(), fault)
+}
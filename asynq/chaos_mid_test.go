@@ -0,0 +1,138 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestChaosMid(t *testing.T, faults string) (asynq.MiddlewareFunc, error) {
+	t.Setenv(ChaosEnvGuard, ChaosEnvGuardValue)
+
+	return NewChaosMid([]byte(fmt.Sprintf(`
+asynq:
+  chaos:
+    enabled: true
+    tasks:
+      chaos:*:
+%s
+`, faults)))
+}
+
+func TestChaosMiddleware(t *testing.T) {
+	calls := 0
+	handler := asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		calls++
+		return nil
+	})
+	task := asynq.NewTask("chaos:test", nil)
+
+	t.Run("SkipRetry", func(t *testing.T) {
+		mid, err := newTestChaosMid(t, `
+        skipRetry:
+          probability: 1`)
+		assert.Nil(t, err)
+
+		err = mid(handler).ProcessTask(context.Background(), task)
+		assert.True(t, errors.Is(err, ErrChaos))
+		assert.True(t, errors.Is(err, asynq.SkipRetry))
+		assert.Equal(t, ErrorClassSkipRetry, ClassifyError(err))
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		mid, err := newTestChaosMid(t, `
+        error:
+          probability: 1`)
+		assert.Nil(t, err)
+
+		err = mid(handler).ProcessTask(context.Background(), task)
+		assert.True(t, errors.Is(err, ErrChaos))
+		assert.False(t, errors.Is(err, asynq.SkipRetry))
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		mid, err := newTestChaosMid(t, `
+        panic:
+          probability: 1`)
+		assert.Nil(t, err)
+
+		assert.Panics(t, func() { mid(handler).ProcessTask(context.Background(), task) })
+	})
+
+	t.Run("Latency", func(t *testing.T) {
+		mid, err := newTestChaosMid(t, `
+        latency:
+          probability: 1
+          duration: 10ms`)
+		assert.Nil(t, err)
+
+		calls = 0
+		assert.Nil(t, mid(handler).ProcessTask(context.Background(), task))
+		assert.Equal(t, 1, calls)
+
+		// task canceled while delayed is failed with ErrChaos and ctx error
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		mid, err = newTestChaosMid(t, `
+        latency:
+          probability: 1
+          duration: 1m`)
+		assert.Nil(t, err)
+
+		err = mid(handler).ProcessTask(ctx, task)
+		assert.True(t, errors.Is(err, ErrChaos))
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("Exclusive", func(t *testing.T) {
+		mid, err := newTestChaosMid(t, `
+        skipRetry:
+          probability: 0.5
+        error:
+          probability: 0.5`)
+		assert.Nil(t, err)
+
+		// ranges cover the whole roll, handler never runs
+		calls = 0
+		for i := 0; i < 100; i++ {
+			assert.True(t, errors.Is(mid(handler).ProcessTask(context.Background(), task), ErrChaos))
+		}
+		assert.Equal(t, 0, calls)
+
+		// other tasks are passed through
+		assert.Nil(t, mid(handler).ProcessTask(context.Background(), asynq.NewTask("order:create", nil)))
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("InvalidProbability", func(t *testing.T) {
+		_, err := newTestChaosMid(t, `
+        panic:
+          probability: 0.5
+        error:
+          probability: 0.6`)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("Guard", func(t *testing.T) {
+		t.Setenv(ChaosEnvGuard, "")
+		mid, err := NewChaosMid([]byte(`
+asynq:
+  chaos:
+    enabled: true
+    tasks:
+      chaos:*:
+        error:
+          probability: 1
+`))
+		assert.Nil(t, err)
+
+		calls = 0
+		assert.Nil(t, mid(handler).ProcessTask(context.Background(), task))
+		assert.Equal(t, 1, calls)
+	})
+}
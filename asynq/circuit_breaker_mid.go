@@ -0,0 +1,330 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerCoolDown         = 30 * time.Second
+	defaultBreakerHalfOpenCalls    = 1
+)
+
+// breakerResult is result of task recorded by breaker
+type breakerResult int
+
+const (
+	breakerSucceeded breakerResult = iota
+	breakerFailed
+	// breakerIgnored is decision of handler or middlewares, not result of downstream
+	breakerIgnored
+)
+
+// BreakerState is state of circuit breaker
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+// String returns name of state
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+
+	return "unknown"
+}
+
+// CircuitBreakerConfig defines thresholds of circuit breaker.
+//
+// Breaker is kept per task type, default values apply to every task type unless overridden in tasks.
+// Consecutive failures reaching failureThreshold open the breaker, after coolDown,
+// halfOpenCalls tasks are allowed to probe downstream. Breaker closes once all of them succeeded,
+// and opens again on any failure. Probes which are rescheduled or failed with SkipRetry are not counted,
+// their slots are given to following tasks.
+//
+// Example:
+//
+//	asynq:
+//	  circuitBreaker:
+//	    enabled: true
+//	    failureThreshold: 5
+//	    coolDown: 30s
+//	    halfOpenCalls: 1
+//	    tasks:
+//	      email:send:
+//	        failureThreshold: 3
+//	        coolDown: 1m
+type CircuitBreakerConfig struct {
+	Asynq struct {
+		CircuitBreaker struct {
+			Enabled          bool   `yaml:"enabled" json:"enabled"`
+			FailureThreshold int    `yaml:"failureThreshold" json:"failureThreshold"`
+			CoolDown         string `yaml:"coolDown" json:"coolDown"`
+			HalfOpenCalls    int    `yaml:"halfOpenCalls" json:"halfOpenCalls"`
+			Tasks            map[string]struct {
+				FailureThreshold int    `yaml:"failureThreshold" json:"failureThreshold"`
+				CoolDown         string `yaml:"coolDown" json:"coolDown"`
+				HalfOpenCalls    int    `yaml:"halfOpenCalls" json:"halfOpenCalls"`
+			} `yaml:"tasks" json:"tasks"`
+		} `yaml:"circuitBreaker" json:"circuitBreaker"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// NewCircuitBreakerMid create middleware which stops running handler of task type while downstream is failing.
+//
+// Task is rescheduled with RescheduleError while breaker is open, use RetryDelayFunc and IsFailure in asynq.Config.
+func NewCircuitBreakerMid(raw []byte) (asynq.MiddlewareFunc, error) {
+	conf := &CircuitBreakerConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	c := conf.Asynq.CircuitBreaker
+
+	def, err := newBreakerSetting(c.FailureThreshold, c.CoolDown, c.HalfOpenCalls, breakerSetting{
+		failureThreshold: defaultBreakerFailureThreshold,
+		coolDown:         defaultBreakerCoolDown,
+		halfOpenCalls:    defaultBreakerHalfOpenCalls,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mid := &CircuitBreakerMiddleware{
+		enabled:  c.Enabled,
+		def:      def,
+		settings: map[string]breakerSetting{},
+		breakers: map[string]*breaker{},
+	}
+
+	for k, v := range c.Tasks {
+		setting, err := newBreakerSetting(v.FailureThreshold, v.CoolDown, v.HalfOpenCalls, def)
+		if err != nil {
+			return nil, fmt.Errorf("invalid circuit breaker of task %s: %v", k, err)
+		}
+		mid.settings[k] = setting
+	}
+
+	return mid.Middleware, nil
+}
+
+type breakerSetting struct {
+	failureThreshold int
+	coolDown         time.Duration
+	halfOpenCalls    int
+}
+
+func newBreakerSetting(failureThreshold int, coolDown string, halfOpenCalls int, def breakerSetting) (breakerSetting, error) {
+	res := def
+
+	if failureThreshold > 0 {
+		res.failureThreshold = failureThreshold
+	}
+
+	if halfOpenCalls > 0 {
+		res.halfOpenCalls = halfOpenCalls
+	}
+
+	if len(coolDown) > 0 {
+		d, err := time.ParseDuration(coolDown)
+		if err != nil {
+			return res, err
+		}
+		res.coolDown = d
+	}
+
+	return res, nil
+}
+
+type CircuitBreakerMiddleware struct {
+	enabled  bool
+	def      breakerSetting
+	settings map[string]breakerSetting
+	lock     sync.Mutex
+	breakers map[string]*breaker
+}
+
+func (m *CircuitBreakerMiddleware) Middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if !m.enabled {
+			return h.ProcessTask(ctx, t)
+		}
+
+		b := m.breaker(t.Type())
+		span := GetSpan(ctx)
+
+		allowed, wait, from, to := b.allow()
+		if from != to {
+			recordBreakerState(span, t.Type(), from, to)
+		}
+
+		if !allowed {
+			span.AddEvent("circuit_open", oteltrace.WithAttributes(
+				attribute.String("asynq.task.type", t.Type()),
+				attribute.String("asynq.circuitBreaker.delay", wait.String()),
+			))
+			incCounter("circuit_breaker_rejected_total", []string{"type"}, t.Type())
+
+			return Reschedule(fmt.Sprintf("circuit breaker of %s is open", t.Type()), wait)
+		}
+
+		return m.process(ctx, h, t, b, span)
+	})
+}
+
+// process run handler and record result on breaker, panic is recorded as failure and re-panicked,
+// otherwise breaker would stay half-open with every probe taken.
+func (m *CircuitBreakerMiddleware) process(ctx context.Context, h asynq.Handler, t *asynq.Task, b *breaker, span oteltrace.Span) error {
+	defer func() {
+		if v := recover(); v != nil {
+			if from, to := b.done(breakerFailed); from != to {
+				recordBreakerState(span, t.Type(), from, to)
+			}
+			panic(v)
+		}
+	}()
+
+	err := h.ProcessTask(ctx, t)
+
+	result := breakerSucceeded
+	switch {
+	case err == nil:
+	case errors.Is(err, asynq.SkipRetry) || IsRescheduled(err):
+		result = breakerIgnored
+	default:
+		result = breakerFailed
+	}
+
+	if from, to := b.done(result); from != to {
+		recordBreakerState(span, t.Type(), from, to)
+	}
+
+	return err
+}
+
+func (m *CircuitBreakerMiddleware) breaker(taskType string) *breaker {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	b, ok := m.breakers[taskType]
+	if !ok {
+		setting, ok := m.settings[taskType]
+		if !ok {
+			setting = m.def
+		}
+		b = &breaker{setting: setting}
+		m.breakers[taskType] = b
+	}
+
+	return b
+}
+
+func recordBreakerState(span oteltrace.Span, taskType string, from, to BreakerState) {
+	span.AddEvent("circuit_state_changed", oteltrace.WithAttributes(
+		attribute.String("asynq.task.type", taskType),
+		attribute.String("asynq.circuitBreaker.from", from.String()),
+		attribute.String("asynq.circuitBreaker.to", to.String()),
+	))
+	incCounter("circuit_breaker_state_change_total", []string{"type", "state"}, taskType, to.String())
+	setGauge("circuit_breaker_state", float64(to), []string{"type"}, taskType)
+}
+
+// breaker is a circuit breaker of single task type
+type breaker struct {
+	lock     sync.Mutex
+	setting  breakerSetting
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probes   int
+	passed   int
+}
+
+// allow returns whether task could run, how long to wait if not, and state transition
+func (b *breaker) allow() (bool, time.Duration, BreakerState, BreakerState) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	from := b.state
+
+	if b.state == BreakerOpen {
+		elapsed := time.Since(b.openedAt)
+		if elapsed < b.setting.coolDown {
+			return false, b.setting.coolDown - elapsed, from, b.state
+		}
+		b.state = BreakerHalfOpen
+		b.probes = 0
+		b.passed = 0
+	}
+
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.setting.halfOpenCalls {
+			return false, b.setting.coolDown, from, b.state
+		}
+		b.probes++
+	}
+
+	return true, 0, from, b.state
+}
+
+// done records result of task and returns state transition
+func (b *breaker) done(result breakerResult) (BreakerState, BreakerState) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	from := b.state
+
+	switch b.state {
+	case BreakerHalfOpen:
+		switch result {
+		case breakerFailed:
+			b.open()
+		case breakerIgnored:
+			// give the slot to another probe
+			if b.probes > 0 {
+				b.probes--
+			}
+		case breakerSucceeded:
+			if b.passed++; b.passed >= b.setting.halfOpenCalls {
+				b.state = BreakerClosed
+				b.failures = 0
+			}
+		}
+	case BreakerClosed:
+		switch result {
+		case breakerFailed:
+			if b.failures++; b.failures >= b.setting.failureThreshold {
+				b.open()
+			}
+		case breakerSucceeded:
+			b.failures = 0
+		}
+	}
+
+	return from, b.state
+}
+
+func (b *breaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	b.failures = 0
+	b.probes = 0
+	b.passed = 0
+}
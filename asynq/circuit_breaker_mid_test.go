@@ -0,0 +1,178 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const testBreakerCoolDown = 50 * time.Millisecond
+
+func TestCircuitBreakerMiddleware_Transitions(t *testing.T) {
+	raw := []byte(`
+asynq:
+  circuitBreaker:
+    enabled: true
+    failureThreshold: 2
+    coolDown: 50ms
+    halfOpenCalls: 1
+`)
+
+	fn, err := NewCircuitBreakerMid(raw)
+	assert.Nil(t, err)
+
+	var run func() error
+	h := fn(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		return run()
+	}))
+
+	fail := func() error { return errors.New("downstream failed") }
+	succeed := func() error { return nil }
+	explode := func() error { panic("boom") }
+
+	process := func(f func() error) error {
+		run = f
+		return h.ProcessTask(context.Background(), asynq.NewTask("breaker", nil))
+	}
+
+	// closed, failures below threshold
+	assert.NotNil(t, process(fail))
+	assert.Nil(t, process(succeed))
+	assert.NotNil(t, process(fail))
+
+	// SkipRetry is not a downstream failure
+	assert.NotNil(t, process(func() error { return asynq.SkipRetry }))
+	assert.False(t, IsRescheduled(process(succeed)))
+
+	// closed -> open
+	assert.NotNil(t, process(fail))
+	run = fail
+	ctx, end := newRecordedContext()
+	assert.NotNil(t, h.ProcessTask(ctx, asynq.NewTask("breaker", nil)))
+	span := end()
+	assert.True(t, hasEvent(span, "circuit_state_changed"))
+
+	ctx, end = newRecordedContext()
+	run = succeed
+	assert.True(t, IsRescheduled(h.ProcessTask(ctx, asynq.NewTask("breaker", nil))))
+	span = end()
+	assert.True(t, hasEvent(span, "circuit_open"))
+
+	// open -> half-open -> closed
+	time.Sleep(testBreakerCoolDown)
+	assert.Nil(t, process(succeed))
+	assert.Nil(t, process(succeed))
+
+	// closed -> open -> half-open -> open
+	assert.NotNil(t, process(fail))
+	assert.NotNil(t, process(fail))
+	time.Sleep(testBreakerCoolDown)
+	assert.NotNil(t, process(fail))
+	assert.True(t, IsRescheduled(process(succeed)))
+
+	// half-open probe panics -> open, and breaker is not stuck in half-open
+	time.Sleep(testBreakerCoolDown)
+	assert.Panics(t, func() { process(explode) })
+	assert.True(t, IsRescheduled(process(succeed)))
+
+	time.Sleep(testBreakerCoolDown)
+	assert.Nil(t, process(succeed))
+	assert.Nil(t, process(succeed))
+}
+
+func TestCircuitBreakerMiddleware_HalfOpenProbes(t *testing.T) {
+	raw := []byte(`
+asynq:
+  circuitBreaker:
+    enabled: true
+    failureThreshold: 1
+    coolDown: 50ms
+    halfOpenCalls: 1
+`)
+
+	fn, err := NewCircuitBreakerMid(raw)
+	assert.Nil(t, err)
+
+	probing := make(chan struct{})
+	finish := make(chan struct{})
+	var run func() error
+	h := fn(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		return run()
+	}))
+
+	run = func() error { return errors.New("downstream failed") }
+	assert.NotNil(t, h.ProcessTask(context.Background(), asynq.NewTask("probe", nil)))
+
+	time.Sleep(testBreakerCoolDown)
+
+	run = func() error {
+		close(probing)
+		<-finish
+		return nil
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- h.ProcessTask(context.Background(), asynq.NewTask("probe", nil))
+	}()
+
+	// only one probe is allowed while half-open
+	<-probing
+	assert.True(t, IsRescheduled(h.ProcessTask(context.Background(), asynq.NewTask("probe", nil))))
+
+	close(finish)
+	assert.Nil(t, <-done)
+}
+
+func TestCircuitBreakerMiddleware_HalfOpenCalls(t *testing.T) {
+	raw := []byte(`
+asynq:
+  circuitBreaker:
+    enabled: true
+    failureThreshold: 1
+    coolDown: 50ms
+    halfOpenCalls: 2
+`)
+
+	fn, err := NewCircuitBreakerMid(raw)
+	assert.Nil(t, err)
+
+	var run func() error
+	h := fn(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		return run()
+	}))
+
+	process := func(f func() error) error {
+		run = f
+		return h.ProcessTask(context.Background(), asynq.NewTask("half-open", nil))
+	}
+	state := func() BreakerState {
+		return BreakerState(gaugeValue("circuit_breaker_state", "half-open"))
+	}
+
+	fail := func() error { return errors.New("downstream failed") }
+	succeed := func() error { return nil }
+	skip := func() error { return asynq.SkipRetry }
+
+	// one probe succeeded and a later one failed
+	assert.NotNil(t, process(fail))
+	assert.Equal(t, BreakerOpen, state())
+	time.Sleep(testBreakerCoolDown)
+
+	assert.Nil(t, process(succeed))
+	assert.Equal(t, BreakerHalfOpen, state())
+	assert.NotNil(t, process(fail))
+	assert.Equal(t, BreakerOpen, state())
+	assert.True(t, IsRescheduled(process(succeed)))
+
+	// SkipRetry probe is not counted and gives its slot to the next one
+	time.Sleep(testBreakerCoolDown)
+	assert.Nil(t, process(succeed))
+	assert.NotNil(t, process(skip))
+	assert.Equal(t, BreakerHalfOpen, state())
+	assert.Nil(t, process(succeed))
+	assert.Equal(t, BreakerClosed, state())
+}
@@ -0,0 +1,280 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"github.com/rs/xid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+const defaultClaimCheckThreshold = 256 << 10
+
+// ErrBlobNotFound is returned by BlobStore while blob is missing
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores payloads offloaded from redis
+type BlobStore interface {
+	Put(ctx context.Context, ref string, data []byte) error
+
+	Get(ctx context.Context, ref string) ([]byte, error)
+
+	Delete(ctx context.Context, ref string) error
+}
+
+// ClaimCheckConfig defines threshold and blob store.
+//
+// Payloads larger than threshold bytes are stored in blob store, and task carries reference only.
+// Local filesystem store is built in, other stores could be passed with NewClaimCheck.
+// Blobs are deleted once task succeeded or is archived, enable keepArchived to keep blobs of archived
+// tasks so that they could be replayed.
+//
+// Example:
+//
+//	asynq:
+//	  claimCheck:
+//	    enabled: true
+//	    threshold: 262144
+//	    keepArchived: false
+//	    file:
+//	      dir: /data/asynq-blobs
+type ClaimCheckConfig struct {
+	Asynq struct {
+		ClaimCheck struct {
+			Enabled      bool `yaml:"enabled" json:"enabled"`
+			Threshold    int  `yaml:"threshold" json:"threshold"`
+			KeepArchived bool `yaml:"keepArchived" json:"keepArchived"`
+			File         struct {
+				Dir string `yaml:"dir" json:"dir"`
+			} `yaml:"file" json:"file"`
+		} `yaml:"claimCheck" json:"claimCheck"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// claimCheckPayload carries reference of blob and trace header
+type claimCheckPayload struct {
+	TraceHeader http.Header `json:"traceHeader,omitempty"`
+	ClaimCheck  struct {
+		Ref string `json:"ref"`
+	} `json:"rkClaimCheck"`
+}
+
+// NewClaimCheck create ClaimCheck from config, local filesystem store is used if store is nil.
+func NewClaimCheck(raw []byte, store BlobStore) (*ClaimCheck, error) {
+	conf := &ClaimCheckConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	c := conf.Asynq.ClaimCheck
+
+	res := &ClaimCheck{
+		enabled:      c.Enabled,
+		threshold:    c.Threshold,
+		keepArchived: c.KeepArchived,
+		store:        store,
+	}
+
+	if res.threshold <= 0 {
+		res.threshold = defaultClaimCheckThreshold
+	}
+
+	if res.enabled && res.store == nil {
+		fileStore, err := NewFileBlobStore(c.File.Dir)
+		if err != nil {
+			return nil, err
+		}
+		res.store = fileStore
+	}
+
+	return res, nil
+}
+
+// ClaimCheck offloads oversized payload into BlobStore
+type ClaimCheck struct {
+	enabled      bool
+	threshold    int
+	keepArchived bool
+	store        BlobStore
+}
+
+// Offload store payload larger than threshold and returns payload with reference and trace header only.
+func (c *ClaimCheck) Offload(ctx context.Context, payload []byte) ([]byte, error) {
+	if !c.enabled || len(payload) <= c.threshold {
+		return payload, nil
+	}
+
+	res := &claimCheckPayload{
+		TraceHeader: readTraceHeader(payload),
+	}
+	res.ClaimCheck.Ref = xid.New().String()
+
+	if err := c.store.Put(ctx, res.ClaimCheck.Ref, payload); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(res)
+}
+
+// NewTask create traced task whose payload is offloaded if oversized, see NewTracedTask
+func (c *ClaimCheck) NewTask(ctx context.Context, typeName string, payload []byte, opts ...asynq.Option) (*asynq.Task, error) {
+	payload, err := InjectTraceHeader(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if payload, err = c.Offload(ctx, payload); err != nil {
+		return nil, err
+	}
+
+	return asynq.NewTask(typeName, payload, opts...), nil
+}
+
+// NewClaimCheckMid create middleware which fetches offloaded payload before handler runs.
+//
+// Blob is deleted after handler succeeded, or failed at the final attempt and the task is archived.
+// Enable keepArchived to keep blob of archived task so that the task could be replayed, see WithReplayBlobStore,
+// delete it from store once archived task is deleted.
+// Middleware should be placed after TraceMiddleware so that fetch failure is recorded on span.
+// Handler receives fetched payload in a new task without ResultWriter, see GetResultWriter.
+func NewClaimCheckMid(raw []byte, store BlobStore) (asynq.MiddlewareFunc, error) {
+	c, err := NewClaimCheck(raw, store)
+	if err != nil {
+		return nil, err
+	}
+
+	mid := &ClaimCheckMiddleware{
+		claimCheck: c,
+	}
+
+	return mid.Middleware, nil
+}
+
+type ClaimCheckMiddleware struct {
+	claimCheck *ClaimCheck
+}
+
+func (m *ClaimCheckMiddleware) Middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		var p claimCheckPayload
+		if !m.claimCheck.enabled || json.Unmarshal(t.Payload(), &p) != nil || len(p.ClaimCheck.Ref) < 1 {
+			return h.ProcessTask(ctx, t)
+		}
+
+		ref := p.ClaimCheck.Ref
+		store := m.claimCheck.store
+
+		span := GetSpan(ctx)
+		span.SetAttributes(attribute.String("asynq.claimCheck.ref", ref))
+
+		payload, err := store.Get(ctx, ref)
+		if err != nil {
+			// blob is gone, retry won't help
+			if errors.Is(err, ErrBlobNotFound) {
+				err = fmt.Errorf("fetch blob %s failed: %v: %w", ref, err, asynq.SkipRetry)
+			}
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
+		ctx, t = replacePayload(ctx, t, payload)
+		err = h.ProcessTask(ctx, t)
+
+		// blob of archived task is kept only if asked to, task is retried with the same blob otherwise
+		if err == nil || (!m.claimCheck.keepArchived && isFinalAttempt(ctx, err)) {
+			if err := store.Delete(ctx, ref); err != nil {
+				span.RecordError(err)
+			}
+		}
+
+		return err
+	})
+}
+
+// ***************** File *****************
+
+var blobRefRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// NewFileBlobStore create BlobStore on local filesystem, directory is created if missing.
+//
+// Directory should be shared by producers and consumers, for example a mounted volume.
+func NewFileBlobStore(dir string) (BlobStore, error) {
+	if len(dir) < 1 {
+		return nil, errors.New("directory of file blob store is required")
+	}
+
+	if !filepath.IsAbs(dir) {
+		wd, _ := os.Getwd()
+		dir = filepath.Join(wd, dir)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &fileBlobStore{dir: dir}, nil
+}
+
+type fileBlobStore struct {
+	dir string
+}
+
+func (s *fileBlobStore) path(ref string) (string, error) {
+	// reference comes from payload, avoid path traversal
+	if !blobRefRegex.MatchString(ref) {
+		return "", fmt.Errorf("invalid blob reference %s", ref)
+	}
+
+	return filepath.Join(s.dir, ref), nil
+}
+
+func (s *fileBlobStore) Put(ctx context.Context, ref string, data []byte) error {
+	path, err := s.path(ref)
+	if err != nil {
+		return err
+	}
+
+	// write into temp file first so that consumer never reads partial blob
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (s *fileBlobStore) Get(ctx context.Context, ref string) ([]byte, error) {
+	path, err := s.path(ref)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, ErrBlobNotFound)
+	}
+
+	res, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%v: %w", err, ErrBlobNotFound)
+	}
+
+	return res, err
+}
+
+func (s *fileBlobStore) Delete(ctx context.Context, ref string) error {
+	path, err := s.path(ref)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestClaimCheckMiddleware(t *testing.T) {
+	ctx := context.Background()
+
+	store, err := NewFileBlobStore(t.TempDir())
+	assert.Nil(t, err)
+
+	raw := []byte(`
+asynq:
+  claimCheck:
+    enabled: true
+    threshold: 1
+`)
+	claimCheck, err := NewClaimCheck(raw, store)
+	assert.Nil(t, err)
+	mid, err := NewClaimCheckMid(raw, store)
+	assert.Nil(t, err)
+
+	// process returns ref of offloaded payload after handled with err
+	process := func(handlerErr error) string {
+		task, err := claimCheck.NewTask(ctx, "claim:test", []byte(`{"amount":1}`))
+		assert.Nil(t, err)
+
+		var p claimCheckPayload
+		assert.Nil(t, json.Unmarshal(task.Payload(), &p))
+
+		var received []byte
+		err = mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+			received = t.Payload()
+			return handlerErr
+		})).ProcessTask(ctx, task)
+		assert.Equal(t, handlerErr, err)
+		assert.Contains(t, string(received), `"amount":1`)
+
+		return p.ClaimCheck.Ref
+	}
+
+	ref := process(nil)
+	_, err = store.Get(ctx, ref)
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+
+	// no retry count in context, which is the final attempt, blob of archived task is deleted
+	ref = process(errors.New("failed"))
+	_, err = store.Get(ctx, ref)
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+
+	// blob of archived task is kept for replay if asked to
+	raw = []byte(`
+asynq:
+  claimCheck:
+    enabled: true
+    threshold: 1
+    keepArchived: true
+`)
+	mid, err = NewClaimCheckMid(raw, store)
+	assert.Nil(t, err)
+
+	ref = process(errors.New("failed"))
+	_, err = store.Get(ctx, ref)
+	assert.Nil(t, err)
+
+	ref = process(nil)
+	_, err = store.Get(ctx, ref)
+	assert.True(t, errors.Is(err, ErrBlobNotFound))
+}
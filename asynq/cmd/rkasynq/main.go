@@ -0,0 +1,115 @@
+// Command rkasynq operates asynq tasks traced by rk-asynq.
+//
+// Usage:
+//
+//	rkasynq <command> [flags]
+//
+// Commands:
+//
+//	replay    list and re-enqueue archived tasks
+//	trace     print trace context of task by ID
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hibiken/asynq"
+	rkasynq "github.com/rookie-ninja/rk-repo/asynq"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/contrib/propagators/jaeger"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"os"
+	"strings"
+)
+
+// cliTraceName is name of shared trace registered by command line
+const cliTraceName = "rk-asynq-cli"
+
+var commands = map[string]func(args []string) error{
+	"replay": runReplay,
+	"trace":  runTrace,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: rkasynq <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  replay    list and re-enqueue archived tasks")
+	fmt.Fprintln(os.Stderr, "  trace     print trace context of task by ID")
+}
+
+// redisFlags register flags of redis connection and returns option built from them
+func redisFlags(fs *flag.FlagSet) func() asynq.RedisConnOpt {
+	addr := fs.String("redis", "127.0.0.1:6379", "redis address")
+	password := fs.String("password", "", "redis password")
+	db := fs.Int("db", 0, "redis database")
+
+	return func() asynq.RedisConnOpt {
+		return asynq.RedisClientOpt{
+			Addr:     *addr,
+			Password: *password,
+			DB:       *db,
+		}
+	}
+}
+
+// propagatorFlag register flag of propagators, which should match the ones of producers and consumers
+func propagatorFlag(fs *flag.FlagSet) *string {
+	return fs.String("propagator", "tracecontext,baggage",
+		"comma separated propagators of traceHeader, tracecontext, baggage, b3 or jaeger")
+}
+
+// registerTrace register shared trace whose spans are not exported,
+// spans started by command line are only used to generate and decode trace headers.
+func registerTrace(propagators string) error {
+	list := make([]propagation.TextMapPropagator, 0)
+	for _, name := range strings.Split(propagators, ",") {
+		switch strings.TrimSpace(name) {
+		case "tracecontext":
+			list = append(list, propagation.TraceContext{})
+		case "baggage":
+			list = append(list, propagation.Baggage{})
+		case "b3":
+			list = append(list, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader|b3.B3SingleHeader)))
+		case "jaeger":
+			list = append(list, jaeger.Jaeger{})
+		case "":
+		default:
+			return fmt.Errorf("unsupported propagator %s", name)
+		}
+	}
+
+	if len(list) < 1 {
+		return fmt.Errorf("propagator is required")
+	}
+
+	rkasynq.RegisterSharedTrace(cliTraceName, sdktrace.NewTracerProvider(),
+		propagation.NewCompositeTextMapPropagator(list...))
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
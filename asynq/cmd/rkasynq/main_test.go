@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	rkasynq "github.com/rookie-ninja/rk-repo/asynq"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"net/http"
+	"testing"
+)
+
+func TestRegisterTrace(t *testing.T) {
+	assert.NotNil(t, registerTrace("tracecontext,zipkin"))
+	assert.NotNil(t, registerTrace(""))
+
+	headers := map[string]http.Header{
+		"tracecontext": {"Traceparent": []string{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}},
+		"b3":           {"B3": []string{"0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-1"}},
+		"jaeger":       {"Uber-Trace-Id": []string{"0af7651916cd43dd8448eb211c80319c:b7ad6b7169203331:0:1"}},
+	}
+
+	for name, header := range headers {
+		assert.Nil(t, registerTrace(name+", baggage"))
+
+		shared, err := rkasynq.GetSharedTrace(cliTraceName)
+		assert.Nil(t, err)
+
+		spanCtx := oteltrace.SpanContextFromContext(
+			shared.Propagator.Extract(context.Background(), propagation.HeaderCarrier(header)))
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", spanCtx.TraceID().String(), name)
+	}
+}
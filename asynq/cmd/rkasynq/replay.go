@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	rkasynq "github.com/rookie-ninja/rk-repo/asynq"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// replayResult is printed for each archived task
+type replayResult struct {
+	Id           string    `json:"id"`
+	Queue        string    `json:"queue"`
+	Type         string    `json:"type"`
+	LastErr      string    `json:"lastErr"`
+	LastFailedAt time.Time `json:"lastFailedAt"`
+	TraceId      string    `json:"traceId,omitempty"`
+	ReplayedId   string    `json:"replayedId,omitempty"`
+	NewTraceId   string    `json:"newTraceId,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	redisOpt := redisFlags(fs)
+	propagators := propagatorFlag(fs)
+
+	filter := &rkasynq.ArchivedFilter{}
+	fs.StringVar(&filter.Queue, "queue", "", "queue of tasks, every queue if empty")
+	fs.StringVar(&filter.Type, "type", "", "type of tasks")
+	fs.StringVar(&filter.ErrorContains, "error", "", "substring of last error")
+	fs.IntVar(&filter.Limit, "limit", 0, "max number of tasks, no limit if 0")
+	since := fs.String("since", "", "last failed at or after, RFC3339 or duration before now, e.g. 2h")
+	until := fs.String("until", "", "last failed at or before, RFC3339 or duration before now")
+	newTrace := fs.Bool("new-trace", false, "start a new trace linked to the original one instead of keeping traceHeader, signed tasks are refused")
+	dryRun := fs.Bool("dry-run", false, "list matched tasks without re-enqueueing")
+	blobDir := fs.String("blob-dir", "", "directory of file blob store, required to replay claim-checked tasks")
+	asJSON := fs.Bool("json", false, "print JSON")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var err error
+	if filter.Since, err = parseTime(*since); err != nil {
+		return fmt.Errorf("invalid -since: %v", err)
+	}
+	if filter.Until, err = parseTime(*until); err != nil {
+		return fmt.Errorf("invalid -until: %v", err)
+	}
+
+	opts := make([]rkasynq.ReplayerOption, 0)
+	if len(*blobDir) > 0 {
+		store, err := rkasynq.NewFileBlobStore(*blobDir)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, rkasynq.WithReplayBlobStore(store))
+	}
+
+	if err := registerTrace(*propagators); err != nil {
+		return err
+	}
+	replayer, err := rkasynq.NewReplayer(redisOpt(), cliTraceName, opts...)
+	if err != nil {
+		return err
+	}
+	defer replayer.Close()
+
+	infos, err := replayer.List(filter)
+	if err != nil {
+		return err
+	}
+
+	res := make([]*replayResult, 0, len(infos))
+	failed := 0
+	for _, info := range infos {
+		r := &replayResult{
+			Id:           info.ID,
+			Queue:        info.Queue,
+			Type:         info.Type,
+			LastErr:      info.LastErr,
+			LastFailedAt: info.LastFailedAt,
+			TraceId:      replayer.TraceIdOf(info.Payload),
+		}
+		res = append(res, r)
+
+		if *dryRun {
+			continue
+		}
+
+		// replayed task is returned along with error if archived task could not be deleted
+		replayed, err := replayer.Replay(context.Background(), info, *newTrace)
+		if replayed != nil {
+			r.ReplayedId = replayed.ID
+			if *newTrace {
+				r.NewTraceId = replayer.TraceIdOf(replayed.Payload)
+			}
+		}
+
+		if err != nil {
+			r.Error = err.Error()
+			failed++
+		}
+	}
+
+	if *asJSON {
+		err = printJSON(res)
+	} else {
+		err = printReplayResults(res, *dryRun)
+	}
+	if err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tasks failed to replay", failed, len(res))
+	}
+
+	return nil
+}
+
+func printReplayResults(res []*replayResult, dryRun bool) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(w, "ID\tQUEUE\tTYPE\tLAST FAILED AT\tTRACE ID\tRESULT\tLAST ERROR")
+	for _, r := range res {
+		result := "dry-run"
+		switch {
+		case len(r.Error) > 0:
+			result = "failed: " + r.Error
+		case !dryRun:
+			result = "replayed as " + r.ReplayedId
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Id, r.Queue, r.Type, r.LastFailedAt.Format(time.RFC3339), r.TraceId, result, r.LastErr)
+	}
+
+	return w.Flush()
+}
+
+// parseTime parse RFC3339 time or duration before now, zero time if empty
+func parseTime(raw string) (time.Time, error) {
+	if len(raw) < 1 {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(raw); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, raw)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/hibiken/asynq"
+	rkasynq "github.com/rookie-ninja/rk-repo/asynq"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+func runTrace(args []string) error {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: rkasynq trace [flags] <task ID>")
+		fs.PrintDefaults()
+	}
+	redisOpt := redisFlags(fs)
+	propagators := propagatorFlag(fs)
+
+	queue := fs.String("queue", "", "queue of task, every queue is searched if empty")
+	asJSON := fs.Bool("json", false, "print JSON")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := registerTrace(*propagators); err != nil {
+		return err
+	}
+	inspector := asynq.NewInspector(redisOpt())
+	defer inspector.Close()
+
+	res, err := rkasynq.LookupTaskTrace(inspector, cliTraceName, *queue, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return printJSON(res)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Task ID:\t%s\n", res.TaskId)
+	fmt.Fprintf(w, "Queue:\t%s\n", res.Queue)
+	fmt.Fprintf(w, "Type:\t%s\n", res.Type)
+	fmt.Fprintf(w, "State:\t%s\n", res.State)
+	fmt.Fprintf(w, "Trace ID:\t%s\n", res.TraceId)
+	fmt.Fprintf(w, "Span ID:\t%s\n", res.SpanId)
+	fmt.Fprintf(w, "Sampled:\t%t\n", res.Sampled)
+
+	keys := make([]string, 0, len(res.Baggage))
+	for k := range res.Baggage {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "Baggage:\t%d\n", len(keys))
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %s\t%s\n", k, res.Baggage[k])
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,221 @@
+package rkasynq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+)
+
+const (
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+
+	defaultCompressionMaxSize = 64 << 20
+)
+
+// CompressionConfig defines codec used by producer and limit of consumer.
+//
+// Payloads smaller than threshold are enqueued as they are, maxSize limits decompressed size.
+//
+// Example:
+//
+//	asynq:
+//	  compression:
+//	    enabled: true
+//	    codec: zstd
+//	    threshold: 1024
+//	    maxSize: 67108864
+type CompressionConfig struct {
+	Asynq struct {
+		Compression struct {
+			Enabled   bool   `yaml:"enabled" json:"enabled"`
+			Codec     string `yaml:"codec" json:"codec"`
+			Threshold int    `yaml:"threshold" json:"threshold"`
+			MaxSize   int64  `yaml:"maxSize" json:"maxSize"`
+		} `yaml:"compression" json:"compression"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// compressedPayload keeps trace header readable beside compressed body
+type compressedPayload struct {
+	TraceHeader http.Header `json:"traceHeader,omitempty"`
+	Compression string      `json:"rkCompression"`
+	Body        []byte      `json:"body"`
+}
+
+// NewCompressor create Compressor used by producers.
+func NewCompressor(raw []byte) (*Compressor, error) {
+	conf := &CompressionConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	c := &Compressor{
+		enabled:   conf.Asynq.Compression.Enabled,
+		codec:     conf.Asynq.Compression.Codec,
+		threshold: conf.Asynq.Compression.Threshold,
+	}
+
+	if len(c.codec) < 1 {
+		c.codec = CodecGzip
+	}
+
+	if c.codec != CodecGzip && c.codec != CodecZstd {
+		return nil, fmt.Errorf("unsupported compression codec %s", c.codec)
+	}
+
+	return c, nil
+}
+
+// Compressor compress payload of producer
+type Compressor struct {
+	enabled   bool
+	codec     string
+	threshold int
+}
+
+// Compress returns envelope of compressed payload whose trace header is copied from payload,
+// payload is returned as it is if compression is disabled or payload is smaller than threshold.
+func (c *Compressor) Compress(payload []byte) ([]byte, error) {
+	if !c.enabled || len(payload) < c.threshold {
+		return payload, nil
+	}
+
+	body, err := compress(c.codec, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&compressedPayload{
+		TraceHeader: readTraceHeader(payload),
+		Compression: c.codec,
+		Body:        body,
+	})
+}
+
+// NewTask create traced task with compressed payload, see NewTracedTask
+func (c *Compressor) NewTask(ctx context.Context, typeName string, payload []byte, opts ...asynq.Option) (*asynq.Task, error) {
+	payload, err := InjectTraceHeader(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if payload, err = c.Compress(payload); err != nil {
+		return nil, err
+	}
+
+	return asynq.NewTask(typeName, payload, opts...), nil
+}
+
+// NewCompressionMid create middleware which decompresses payload before following middlewares and handler.
+//
+// Middleware should be placed before TraceMiddleware so that trace and handler see decompressed payload.
+// Payload without compression is passed as it is, so that compressed and uncompressed payloads
+// could be mixed during rollout. If payload is compressed before encryption, place another one after
+// EncryptionMiddleware, see package doc for the whole chain.
+// Decompressed task has no ResultWriter, handlers must write result with GetResultWriter.
+func NewCompressionMid(raw []byte) (asynq.MiddlewareFunc, error) {
+	conf := &CompressionConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	mid := &CompressionMiddleware{
+		maxSize: conf.Asynq.Compression.MaxSize,
+	}
+
+	if mid.maxSize <= 0 {
+		mid.maxSize = defaultCompressionMaxSize
+	}
+
+	return mid.Middleware, nil
+}
+
+type CompressionMiddleware struct {
+	maxSize int64
+}
+
+func (m *CompressionMiddleware) Middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		var p compressedPayload
+		if err := json.Unmarshal(t.Payload(), &p); err != nil || len(p.Compression) < 1 || len(p.Body) < 1 {
+			return h.ProcessTask(ctx, t)
+		}
+
+		payload, err := decompress(p.Compression, p.Body, m.maxSize)
+		if err != nil {
+			return fmt.Errorf("decompress failed: %v: %w", err, ErrUndecodable)
+		}
+
+		ctx, t = replacePayload(ctx, t, payload)
+		return h.ProcessTask(ctx, t)
+	})
+}
+
+func compress(codec string, payload []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	var writer io.WriteCloser
+	switch codec {
+	case CodecGzip:
+		writer = gzip.NewWriter(buf)
+	case CodecZstd:
+		w, err := zstd.NewWriter(buf)
+		if err != nil {
+			return nil, err
+		}
+		writer = w
+	default:
+		return nil, fmt.Errorf("unsupported compression codec %s", codec)
+	}
+
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompress(codec string, body []byte, maxSize int64) ([]byte, error) {
+	var reader io.Reader
+	switch codec {
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		reader = r
+	case CodecZstd:
+		r, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		reader = r
+	default:
+		return nil, fmt.Errorf("unsupported compression codec %s", codec)
+	}
+
+	res, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(res)) > maxSize {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", maxSize)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,339 @@
+package rkasynq
+
+import (
+	"context"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/xid"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConcurrencyKeyPrefix = "rk:asynq:concurrency:"
+	defaultConcurrencyDelay     = time.Second
+	defaultConcurrencyLeaseTTL  = 30 * time.Second
+
+	// lease is renewed every third of TTL, shorter lease could not be renewed reliably over network
+	minConcurrencyLeaseTTL = 100 * time.Millisecond
+)
+
+// ConcurrencyConfig defines in-flight limits per task type or pattern.
+//
+// Pattern follows path.Match, tasks matched by the same pattern share the same limit.
+// Local limit is enforced per process, cluster limit is enforced with redis across all workers.
+//
+// Example:
+//
+//	asynq:
+//	  concurrency:
+//	    enabled: true
+//	    delay: 1s
+//	    leaseTTL: 30s
+//	    tasks:
+//	      email:*:
+//	        local: 5
+//	        cluster: 20
+type ConcurrencyConfig struct {
+	Asynq struct {
+		Concurrency struct {
+			Enabled   bool   `yaml:"enabled" json:"enabled"`
+			Delay     string `yaml:"delay" json:"delay"`
+			LeaseTTL  string `yaml:"leaseTTL" json:"leaseTTL"`
+			KeyPrefix string `yaml:"keyPrefix" json:"keyPrefix"`
+			Tasks     map[string]struct {
+				Local   int `yaml:"local" json:"local"`
+				Cluster int `yaml:"cluster" json:"cluster"`
+			} `yaml:"tasks" json:"tasks"`
+		} `yaml:"concurrency" json:"concurrency"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// ConcurrencyLimiter acquires a slot of key, release should be called once task finished.
+type ConcurrencyLimiter interface {
+	Acquire(ctx context.Context, key string, limit int) (release func(), ok bool, err error)
+}
+
+// NewConcurrencyMid create middleware which caps in-flight executions per task type or pattern.
+//
+// redisOpt is required if any cluster limit is configured, pass the same option used by asynq.Server.
+// Over-limit task is rescheduled with RescheduleError, use RetryDelayFunc and IsFailure in asynq.Config.
+func NewConcurrencyMid(raw []byte, redisOpt asynq.RedisConnOpt) (asynq.MiddlewareFunc, error) {
+	conf := &ConcurrencyConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	mid := &ConcurrencyMiddleware{
+		enabled: conf.Asynq.Concurrency.Enabled,
+		delay:   defaultConcurrencyDelay,
+		limits:  map[string]concurrencyLimit{},
+		local:   NewLocalConcurrencyLimiter(),
+	}
+
+	if len(conf.Asynq.Concurrency.Delay) > 0 {
+		d, err := time.ParseDuration(conf.Asynq.Concurrency.Delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid concurrency delay: %v", err)
+		}
+		mid.delay = d
+	}
+
+	leaseTTL := defaultConcurrencyLeaseTTL
+	if len(conf.Asynq.Concurrency.LeaseTTL) > 0 {
+		d, err := time.ParseDuration(conf.Asynq.Concurrency.LeaseTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid concurrency lease ttl: %v", err)
+		}
+		if d < minConcurrencyLeaseTTL {
+			return nil, fmt.Errorf("concurrency lease ttl %s is shorter than %s", d, minConcurrencyLeaseTTL)
+		}
+		leaseTTL = d
+	}
+
+	needRedis := false
+	for k, v := range conf.Asynq.Concurrency.Tasks {
+		if _, err := path.Match(k, ""); err != nil {
+			return nil, fmt.Errorf("invalid task pattern %s: %v", k, err)
+		}
+		mid.limits[k] = concurrencyLimit{local: v.Local, cluster: v.Cluster}
+		mid.patterns = append(mid.patterns, k)
+		needRedis = needRedis || v.Cluster > 0
+	}
+
+	// longer pattern is more specific
+	sort.Slice(mid.patterns, func(i, j int) bool {
+		return len(mid.patterns[i]) > len(mid.patterns[j])
+	})
+
+	if mid.enabled && needRedis {
+		client, err := NewRedisClient(redisOpt)
+		if err != nil {
+			return nil, err
+		}
+		mid.cluster = NewRedisConcurrencyLimiter(client, conf.Asynq.Concurrency.KeyPrefix, leaseTTL)
+	}
+
+	return mid.Middleware, nil
+}
+
+type concurrencyLimit struct {
+	local   int
+	cluster int
+}
+
+type ConcurrencyMiddleware struct {
+	enabled  bool
+	delay    time.Duration
+	patterns []string
+	limits   map[string]concurrencyLimit
+	local    ConcurrencyLimiter
+	cluster  ConcurrencyLimiter
+}
+
+func (m *ConcurrencyMiddleware) Middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if !m.enabled {
+			return h.ProcessTask(ctx, t)
+		}
+
+		pattern, ok := matchTaskPattern(m.patterns, t.Type())
+		if !ok {
+			return h.ProcessTask(ctx, t)
+		}
+
+		limit := m.limits[pattern]
+		span := GetSpan(ctx)
+
+		if limit.local > 0 {
+			release, ok, _ := m.local.Acquire(ctx, pattern, limit.local)
+			if !ok {
+				return m.reschedule(span, t, pattern, "local", limit.local)
+			}
+			defer release()
+		}
+
+		if limit.cluster > 0 && m.cluster != nil {
+			release, ok, err := m.cluster.Acquire(ctx, pattern, limit.cluster)
+			if err != nil {
+				// fail open, local limit still applies
+				span.RecordError(err)
+			} else if !ok {
+				return m.reschedule(span, t, pattern, "cluster", limit.cluster)
+			} else {
+				defer release()
+			}
+		}
+
+		return h.ProcessTask(ctx, t)
+	})
+}
+
+func (m *ConcurrencyMiddleware) reschedule(span oteltrace.Span, t *asynq.Task, pattern, scope string, limit int) error {
+	span.AddEvent("concurrency_limited", oteltrace.WithAttributes(
+		attribute.String("asynq.task.type", t.Type()),
+		attribute.String("asynq.concurrency.pattern", pattern),
+		attribute.String("asynq.concurrency.scope", scope),
+		attribute.Int("asynq.concurrency.limit", limit),
+		attribute.String("asynq.concurrency.delay", m.delay.String()),
+	))
+
+	return Reschedule(fmt.Sprintf("%s concurrency limit %d of %s reached", scope, limit, pattern), m.delay)
+}
+
+// matchTaskPattern returns first pattern matching task type, patterns should be sorted by priority
+func matchTaskPattern(patterns []string, taskType string) (string, bool) {
+	for _, p := range patterns {
+		if p == taskType {
+			return p, true
+		}
+	}
+
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, taskType); ok {
+			return p, true
+		}
+	}
+
+	return "", false
+}
+
+// ***************** Local *****************
+
+// NewLocalConcurrencyLimiter create in-process ConcurrencyLimiter with semaphore per key
+func NewLocalConcurrencyLimiter() ConcurrencyLimiter {
+	return &localConcurrencyLimiter{
+		semaphores: map[string]chan struct{}{},
+	}
+}
+
+type localConcurrencyLimiter struct {
+	lock       sync.Mutex
+	semaphores map[string]chan struct{}
+}
+
+func (l *localConcurrencyLimiter) Acquire(ctx context.Context, key string, limit int) (func(), bool, error) {
+	l.lock.Lock()
+	sem, ok := l.semaphores[key]
+	if !ok {
+		sem = make(chan struct{}, limit)
+		l.semaphores[key] = sem
+	}
+	l.lock.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, true, nil
+	default:
+		return nil, false, nil
+	}
+}
+
+// ***************** Redis *****************
+
+// leases are stored in sorted set scored by expiry, expired leases of crashed workers are evicted on acquire
+var redisAcquireLeaseScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[2]), ARGV[3])
+redis.call("PEXPIRE", KEYS[1], tonumber(ARGV[2]) * 2)
+return 1
+`)
+
+// returns 0 if lease is gone, for example evicted after worker was paused longer than TTL
+var redisRenewLeaseScript = redis.NewScript(`
+if not redis.call("ZSCORE", KEYS[1], ARGV[2]) then
+	return 0
+end
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call("ZADD", KEYS[1], "XX", now + tonumber(ARGV[1]), ARGV[2])
+redis.call("PEXPIRE", KEYS[1], tonumber(ARGV[1]) * 2)
+return 1
+`)
+
+// NewRedisConcurrencyLimiter create cluster-wide ConcurrencyLimiter,
+// lease is renewed while task is running and expires after leaseTTL if worker crashed.
+//
+// Failed renewal is counted by concurrency_lease_renew_failed_total, since limit could be exceeded
+// once lease expires while task is still running.
+func NewRedisConcurrencyLimiter(client redis.UniversalClient, keyPrefix string, leaseTTL time.Duration) ConcurrencyLimiter {
+	if len(keyPrefix) < 1 {
+		keyPrefix = defaultConcurrencyKeyPrefix
+	}
+
+	if leaseTTL <= 0 {
+		leaseTTL = defaultConcurrencyLeaseTTL
+	}
+
+	if leaseTTL < minConcurrencyLeaseTTL {
+		leaseTTL = minConcurrencyLeaseTTL
+	}
+
+	return &redisConcurrencyLimiter{
+		client:    client,
+		keyPrefix: keyPrefix,
+		leaseTTL:  leaseTTL,
+	}
+}
+
+type redisConcurrencyLimiter struct {
+	client    redis.UniversalClient
+	keyPrefix string
+	leaseTTL  time.Duration
+}
+
+func (l *redisConcurrencyLimiter) Acquire(ctx context.Context, key string, limit int) (func(), bool, error) {
+	redisKey := l.keyPrefix + key
+	lease := xid.New().String()
+	ttl := l.leaseTTL.Milliseconds()
+
+	ok, err := redisAcquireLeaseScript.Run(ctx, l.client, []string{redisKey}, limit, ttl, lease).Int()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if ok != 1 {
+		return nil, false, nil
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(l.leaseTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ok, err := redisRenewLeaseScript.Run(context.Background(), l.client, []string{redisKey}, ttl, lease).Int()
+				switch {
+				case err != nil:
+					incCounter("concurrency_lease_renew_failed_total", []string{"key", "reason"}, key, "error")
+				case ok != 1:
+					incCounter("concurrency_lease_renew_failed_total", []string{"key", "reason"}, key, "lost")
+					// nothing left to renew
+					return
+				}
+			}
+		}
+	}()
+
+	release := func() {
+		close(stop)
+		l.client.ZRem(context.Background(), redisKey, lease)
+	}
+
+	return release, true, nil
+}
@@ -0,0 +1,128 @@
+package rkasynq
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNewConcurrencyMid_LeaseTTL(t *testing.T) {
+	raw := []byte(`
+asynq:
+  concurrency:
+    enabled: true
+    leaseTTL: 1ns
+`)
+
+	_, err := NewConcurrencyMid(raw, nil)
+	assert.NotNil(t, err)
+}
+
+func TestLocalConcurrencyLimiter_Acquire(t *testing.T) {
+	limiter := NewLocalConcurrencyLimiter()
+	ctx := context.Background()
+
+	release, ok, err := limiter.Acquire(ctx, "a", 1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	_, ok, _ = limiter.Acquire(ctx, "a", 1)
+	assert.False(t, ok)
+
+	release()
+
+	_, ok, _ = limiter.Acquire(ctx, "a", 1)
+	assert.True(t, ok)
+}
+
+func TestRedisConcurrencyLimiter_Acquire(t *testing.T) {
+	_, _, client := newTestRedis(t)
+	limiter := NewRedisConcurrencyLimiter(client, "", time.Second)
+	ctx := context.Background()
+
+	first, ok, err := limiter.Acquire(ctx, "a", 2)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	second, ok, err := limiter.Acquire(ctx, "a", 2)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	_, ok, err = limiter.Acquire(ctx, "a", 2)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// key is shared by pattern only
+	release, ok, err := limiter.Acquire(ctx, "b", 2)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	release()
+
+	first()
+
+	third, ok, err := limiter.Acquire(ctx, "a", 2)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	second()
+	third()
+	assert.Zero(t, client.ZCard(ctx, defaultConcurrencyKeyPrefix+"a").Val())
+}
+
+func TestRedisConcurrencyLimiter_Renew(t *testing.T) {
+	_, _, client := newTestRedis(t)
+	limiter := NewRedisConcurrencyLimiter(client, "", minConcurrencyLeaseTTL)
+	ctx := context.Background()
+
+	release, ok, err := limiter.Acquire(ctx, "renew", 1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// lease outlives its TTL while renewed
+	time.Sleep(3 * minConcurrencyLeaseTTL)
+
+	_, ok, err = limiter.Acquire(ctx, "renew", 1)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	release()
+}
+
+func TestRedisConcurrencyLimiter_RenewLost(t *testing.T) {
+	_, _, client := newTestRedis(t)
+	limiter := NewRedisConcurrencyLimiter(client, "", minConcurrencyLeaseTTL)
+	ctx := context.Background()
+
+	before := counterValue("concurrency_lease_renew_failed_total", "lost-key", "lost")
+
+	release, ok, err := limiter.Acquire(ctx, "lost-key", 1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	defer release()
+
+	// lease evicted, for example worker paused longer than TTL
+	client.Del(ctx, defaultConcurrencyKeyPrefix+"lost-key")
+
+	time.Sleep(minConcurrencyLeaseTTL)
+
+	assert.Equal(t, before+1, counterValue("concurrency_lease_renew_failed_total", "lost-key", "lost"))
+}
+
+func TestRedisConcurrencyLimiter_RenewError(t *testing.T) {
+	mr, _, client := newTestRedis(t)
+	limiter := NewRedisConcurrencyLimiter(client, "", minConcurrencyLeaseTTL)
+	ctx := context.Background()
+
+	release, ok, err := limiter.Acquire(ctx, "error-key", 1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	defer release()
+
+	mr.Close()
+
+	// client retries with backoff before renewal fails
+	assert.Eventually(t, func() bool {
+		return counterValue("concurrency_lease_renew_failed_total", "error-key", "error") > 0
+	}, 5*time.Second, minConcurrencyLeaseTTL)
+}
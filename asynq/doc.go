@@ -0,0 +1,28 @@
+// Package rkasynq provides tracing, payload envelopes and middlewares for asynq.
+//
+// Producers wrap payload into envelopes, each of them copies traceHeader of inner payload so that trace
+// stays readable, and keeps its own fields under rk prefixed keys, rkCompression, rkEncryption, rkSignature
+// and rkClaimCheck, so that they won't collide with fields of user payload.
+// Envelopes are applied in the following order:
+//
+//	InjectTraceHeader -> SetPayloadVersion -> Compressor -> Encryptor -> Signer -> ClaimCheck
+//
+// Consumers unwrap them in reverse order, middlewares are registered with asynq.ServeMux.Use as:
+//
+//	QuarantineMiddleware
+//	CompressionMiddleware
+//	TraceMiddleware
+//	ClaimCheckMiddleware
+//	SigningMiddleware
+//	EncryptionMiddleware
+//	CompressionMiddleware, only if payloads are compressed before encryption
+//	VersioningMiddleware
+//	SchemaMiddleware
+//	other middlewares, for example IdempotencyMiddleware, TimeoutMiddleware and ChaosMiddleware
+//
+// CompressionMiddleware passes payloads which are not compressed as they are, the first one decompresses
+// payloads which are only compressed, before TraceMiddleware, and the second one payloads which are unwrapped
+// from encryption.
+//
+// Middlewares which unwrap payload pass a new task to handler, see GetResultWriter.
+package rkasynq
@@ -0,0 +1,255 @@
+package rkasynq
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// EncryptionConfig defines AES-GCM keys identified by key ID.
+//
+// Key is base64 encoded 16, 24 or 32 bytes, loaded from file or environment variable.
+// Producers encrypt with activeKey, consumers decrypt with key ID in envelope,
+// so that old keys could be kept for tasks enqueued before rotation.
+//
+// Example:
+//
+//	asynq:
+//	  encryption:
+//	    enabled: true
+//	    activeKey: k2
+//	    keys:
+//	      - id: k1
+//	        file: /etc/asynq/k1.key
+//	      - id: k2
+//	        env: ASYNQ_KEY_K2
+type EncryptionConfig struct {
+	Asynq struct {
+		Encryption struct {
+			Enabled   bool   `yaml:"enabled" json:"enabled"`
+			ActiveKey string `yaml:"activeKey" json:"activeKey"`
+			Keys      []struct {
+				Id   string `yaml:"id" json:"id"`
+				File string `yaml:"file" json:"file"`
+				Env  string `yaml:"env" json:"env"`
+			} `yaml:"keys" json:"keys"`
+		} `yaml:"encryption" json:"encryption"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// encryptedPayload keeps trace header readable beside encrypted body
+type encryptedPayload struct {
+	TraceHeader http.Header `json:"traceHeader,omitempty"`
+	Encryption  struct {
+		KeyId string `json:"keyId"`
+		Nonce []byte `json:"nonce"`
+	} `json:"rkEncryption"`
+	Body []byte `json:"body"`
+}
+
+// NewEncryptor create Encryptor from config, used by both producers and EncryptionMiddleware.
+func NewEncryptor(raw []byte) (*Encryptor, error) {
+	conf := &EncryptionConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	c := conf.Asynq.Encryption
+
+	e := &Encryptor{
+		enabled:   c.Enabled,
+		activeKey: c.ActiveKey,
+		keys:      map[string]cipher.AEAD{},
+	}
+
+	if !e.enabled {
+		return e, nil
+	}
+
+	for _, k := range c.Keys {
+		key, err := loadKey(k.File, k.Env)
+		if err != nil {
+			return nil, fmt.Errorf("load encryption key %s failed: %v", k.Id, err)
+		}
+
+		if err := e.AddKey(k.Id, key); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := e.keys[e.activeKey]; !ok {
+		return nil, fmt.Errorf("active encryption key %s not found", e.activeKey)
+	}
+
+	return e, nil
+}
+
+// Encryptor encrypt and decrypt payload with AES-GCM
+type Encryptor struct {
+	enabled   bool
+	activeKey string
+	keys      map[string]cipher.AEAD
+}
+
+// AddKey add AES key with ID, key should be 16, 24 or 32 bytes
+func (e *Encryptor) AddKey(id string, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("invalid encryption key %s: %v", id, err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	e.keys[id] = aead
+	return nil
+}
+
+// Encrypt returns envelope of encrypted payload with active key, trace header is copied from payload.
+func (e *Encryptor) Encrypt(payload []byte) ([]byte, error) {
+	if !e.enabled {
+		return payload, nil
+	}
+
+	aead, ok := e.keys[e.activeKey]
+	if !ok {
+		return nil, fmt.Errorf("active encryption key %s not found", e.activeKey)
+	}
+
+	res := &encryptedPayload{
+		TraceHeader: readTraceHeader(payload),
+	}
+	res.Encryption.KeyId = e.activeKey
+	res.Encryption.Nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, res.Encryption.Nonce); err != nil {
+		return nil, err
+	}
+
+	// key ID is bound as additional data, so that it could not be swapped
+	res.Body = aead.Seal(nil, res.Encryption.Nonce, payload, []byte(e.activeKey))
+
+	return json.Marshal(res)
+}
+
+// NewTask create traced task with encrypted payload, see NewTracedTask
+func (e *Encryptor) NewTask(ctx context.Context, typeName string, payload []byte, opts ...asynq.Option) (*asynq.Task, error) {
+	payload, err := InjectTraceHeader(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if payload, err = e.Encrypt(payload); err != nil {
+		return nil, err
+	}
+
+	return asynq.NewTask(typeName, payload, opts...), nil
+}
+
+// decrypt returns plaintext and true if payload is encrypted envelope
+func (e *Encryptor) decrypt(payload []byte) ([]byte, string, bool, error) {
+	var p encryptedPayload
+	if err := json.Unmarshal(payload, &p); err != nil || len(p.Encryption.KeyId) < 1 {
+		return payload, "", false, nil
+	}
+
+	aead, ok := e.keys[p.Encryption.KeyId]
+	if !ok {
+		return nil, p.Encryption.KeyId, true, fmt.Errorf("encryption key %s not found", p.Encryption.KeyId)
+	}
+
+	if len(p.Encryption.Nonce) != aead.NonceSize() {
+		return nil, p.Encryption.KeyId, true, fmt.Errorf("invalid nonce size %d", len(p.Encryption.Nonce))
+	}
+
+	res, err := aead.Open(nil, p.Encryption.Nonce, p.Body, []byte(p.Encryption.KeyId))
+	return res, p.Encryption.KeyId, true, err
+}
+
+// NewEncryptionMid create middleware which decrypts payload before handler runs.
+//
+// Middleware should be placed after TraceMiddleware so that failure is recorded on span,
+// trace header is kept in plaintext for TraceMiddleware and is not authenticated, combine with SigningMiddleware
+// if it must not be tampered. Payload without encryption is passed as it is.
+// If payload is compressed before encryption, place CompressionMiddleware after this middleware.
+// Decrypted task is passed without ResultWriter, use GetResultWriter in handlers.
+func NewEncryptionMid(raw []byte) (asynq.MiddlewareFunc, error) {
+	e, err := NewEncryptor(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	mid := &EncryptionMiddleware{
+		encryptor: e,
+	}
+
+	return mid.Middleware, nil
+}
+
+type EncryptionMiddleware struct {
+	encryptor *Encryptor
+}
+
+func (m *EncryptionMiddleware) Middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if !m.encryptor.enabled {
+			return h.ProcessTask(ctx, t)
+		}
+
+		payload, keyId, encrypted, err := m.encryptor.decrypt(t.Payload())
+		if !encrypted {
+			return h.ProcessTask(ctx, t)
+		}
+
+		span := GetSpan(ctx)
+		span.SetAttributes(attribute.String("asynq.encryption.keyId", keyId))
+
+		if err != nil {
+			err = fmt.Errorf("decrypt failed: %v: %w", err, ErrUndecodable)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
+		ctx, t = replacePayload(ctx, t, payload)
+		return h.ProcessTask(ctx, t)
+	})
+}
+
+// loadKey read base64 encoded key from file or environment variable
+func loadKey(file, env string) ([]byte, error) {
+	var raw string
+
+	switch {
+	case len(file) > 0:
+		bytes, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		raw = string(bytes)
+	case len(env) > 0:
+		raw = os.Getenv(env)
+	default:
+		return nil, fmt.Errorf("either file or env is required")
+	}
+
+	raw = strings.TrimSpace(raw)
+	if len(raw) < 1 {
+		return nil, fmt.Errorf("key is empty")
+	}
+
+	return base64.StdEncoding.DecodeString(raw)
+}
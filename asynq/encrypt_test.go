@@ -0,0 +1,165 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+const (
+	testEncryptionKey1 = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	testEncryptionKey2 = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+// editEnvelope decode payload into map, apply fn and encode it back
+func editEnvelope(t *testing.T, payload []byte, fn func(m map[string]interface{})) []byte {
+	m := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(payload, &m))
+	fn(m)
+
+	res, err := json.Marshal(m)
+	assert.Nil(t, err)
+
+	return res
+}
+
+func newTestEncryptionMid(t *testing.T, raw string) asynq.MiddlewareFunc {
+	mid, err := NewEncryptionMid([]byte(raw))
+	assert.Nil(t, err)
+
+	return mid
+}
+
+// decryptWith run payload through middleware and returns payload received by handler
+func decryptWith(mid asynq.MiddlewareFunc, payload []byte) ([]byte, error) {
+	var res []byte
+	err := mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		res = t.Payload()
+		return nil
+	})).ProcessTask(context.Background(), asynq.NewTask("encrypt:test", payload))
+
+	return res, err
+}
+
+func TestEncryptionMiddleware(t *testing.T) {
+	t.Setenv("TEST_ASYNQ_K1", testEncryptionKey1)
+	t.Setenv("TEST_ASYNQ_K2", testEncryptionKey2)
+
+	encryptor, err := NewEncryptor([]byte(`
+asynq:
+  encryption:
+    enabled: true
+    activeKey: k1
+    keys:
+      - id: k1
+        env: TEST_ASYNQ_K1
+`))
+	assert.Nil(t, err)
+
+	original := []byte(`{"traceHeader":{"Traceparent":["00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"]},"amount":1}`)
+	payload, err := encryptor.Encrypt(original)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(payload), "amount")
+
+	// k2 is active after rotation, k1 is kept for tasks enqueued before
+	rotated := newTestEncryptionMid(t, `
+asynq:
+  encryption:
+    enabled: true
+    activeKey: k2
+    keys:
+      - id: k1
+        env: TEST_ASYNQ_K1
+      - id: k2
+        env: TEST_ASYNQ_K2
+`)
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		res, err := decryptWith(rotated, payload)
+		assert.Nil(t, err)
+		assert.Equal(t, original, res)
+
+		// plaintext is passed as it is
+		res, err = decryptWith(rotated, original)
+		assert.Nil(t, err)
+		assert.Equal(t, original, res)
+	})
+
+	t.Run("RotatedOutKey", func(t *testing.T) {
+		mid := newTestEncryptionMid(t, `
+asynq:
+  encryption:
+    enabled: true
+    activeKey: k2
+    keys:
+      - id: k2
+        env: TEST_ASYNQ_K2
+`)
+
+		_, err := decryptWith(mid, payload)
+		assert.True(t, errors.Is(err, ErrUndecodable))
+		assert.True(t, errors.Is(err, asynq.SkipRetry))
+	})
+
+	t.Run("UnknownKey", func(t *testing.T) {
+		tampered := editEnvelope(t, payload, func(m map[string]interface{}) {
+			m["rkEncryption"].(map[string]interface{})["keyId"] = "k9"
+		})
+
+		_, err := decryptWith(rotated, tampered)
+		assert.True(t, errors.Is(err, ErrUndecodable))
+	})
+
+	t.Run("SwappedKeyId", func(t *testing.T) {
+		// the same key under another ID, key ID is bound as additional data
+		mid := newTestEncryptionMid(t, `
+asynq:
+  encryption:
+    enabled: true
+    activeKey: k1
+    keys:
+      - id: k1
+        env: TEST_ASYNQ_K1
+      - id: k1-copy
+        env: TEST_ASYNQ_K1
+`)
+
+		tampered := editEnvelope(t, payload, func(m map[string]interface{}) {
+			m["rkEncryption"].(map[string]interface{})["keyId"] = "k1-copy"
+		})
+
+		_, err := decryptWith(mid, tampered)
+		assert.True(t, errors.Is(err, ErrUndecodable))
+	})
+
+	t.Run("ModifiedBody", func(t *testing.T) {
+		var p encryptedPayload
+		assert.Nil(t, json.Unmarshal(payload, &p))
+		p.Body[0] ^= 0xff
+
+		tampered, err := json.Marshal(&p)
+		assert.Nil(t, err)
+
+		_, err = decryptWith(rotated, tampered)
+		assert.True(t, errors.Is(err, ErrUndecodable))
+	})
+
+	t.Run("ModifiedTraceHeader", func(t *testing.T) {
+		// trace header beside body is not authenticated, use SigningMiddleware to reject it,
+		// decrypted payload keeps the original one
+		var p encryptedPayload
+		assert.Nil(t, json.Unmarshal(payload, &p))
+		p.TraceHeader = http.Header{"Traceparent": []string{"00-11111111111111111111111111111111-2222222222222222-01"}}
+
+		tampered, err := json.Marshal(&p)
+		assert.Nil(t, err)
+
+		res, err := decryptWith(rotated, tampered)
+		assert.Nil(t, err)
+		assert.Equal(t, original, res)
+	})
+}
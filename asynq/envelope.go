@@ -0,0 +1,80 @@
+package rkasynq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/hibiken/asynq"
+	"net/http"
+)
+
+const resultWriterKey = "ResultWriterKey"
+
+// replacePayload returns task with the same type and new payload.
+//
+// Task created with asynq.NewTask has no result writer, the original one is kept in context, see GetResultWriter.
+// The original task is returned if payload is unchanged.
+func replacePayload(ctx context.Context, t *asynq.Task, payload []byte) (context.Context, *asynq.Task) {
+	if bytes.Equal(t.Payload(), payload) {
+		return ctx, t
+	}
+
+	if GetResultWriter(ctx, t) == nil && t.ResultWriter() != nil {
+		ctx = context.WithValue(ctx, resultWriterKey, t.ResultWriter())
+	}
+
+	return ctx, asynq.NewTask(t.Type(), payload)
+}
+
+// GetResultWriter returns result writer of task,
+// or the one of original task if payload is replaced by middlewares, for example decompression.
+//
+// Middlewares which replace payload pass a task created with asynq.NewTask to handler, whose
+// ResultWriter() returns nil, handlers behind them must use GetResultWriter instead.
+//
+// Example:
+//
+//	func handle(ctx context.Context, t *asynq.Task) error {
+//		if writer := rkasynq.GetResultWriter(ctx, t); writer != nil {
+//			_, err := writer.Write(result)
+//			return err
+//		}
+//		return nil
+//	}
+func GetResultWriter(ctx context.Context, t *asynq.Task) *asynq.ResultWriter {
+	if t != nil && t.ResultWriter() != nil {
+		return t.ResultWriter()
+	}
+
+	if v, ok := ctx.Value(resultWriterKey).(*asynq.ResultWriter); ok {
+		return v
+	}
+
+	return nil
+}
+
+// readTraceHeader returns trace header of JSON payload, nil if missing
+func readTraceHeader(payload []byte) http.Header {
+	var p basePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil
+	}
+
+	return p.TraceHeader
+}
+
+// readTraceLinks returns trace headers of linked traces, nil if missing.
+//
+// Field is decoded separately and errors are ignored, so that payloads which have traceLinks
+// field of other shape are still accepted.
+func readTraceLinks(payload []byte) []http.Header {
+	var p struct {
+		TraceLinks []http.Header `json:"traceLinks"`
+	}
+
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil
+	}
+
+	return p.TraceLinks
+}
@@ -0,0 +1,149 @@
+package rkasynq
+
+import (
+	"context"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+func TestReplacePayload(t *testing.T) {
+	ctx := context.Background()
+	task := asynq.NewTask("envelope:test", []byte("payload"))
+
+	// unchanged payload keeps the original task
+	resCtx, res := replacePayload(ctx, task, []byte("payload"))
+	assert.Equal(t, ctx, resCtx)
+	assert.Same(t, task, res)
+
+	resCtx, res = replacePayload(ctx, task, []byte("replaced"))
+	assert.NotSame(t, task, res)
+	assert.Equal(t, "envelope:test", res.Type())
+	assert.Equal(t, []byte("replaced"), res.Payload())
+	assert.Nil(t, GetResultWriter(resCtx, res))
+}
+
+func TestEnvelopeChain(t *testing.T) {
+	t.Setenv("TEST_ASYNQ_KEY", testEncryptionKey1)
+	t.Setenv("TEST_ASYNQ_SECRET", "c2VjcmV0")
+
+	compressor, err := NewCompressor([]byte(`
+asynq:
+  compression:
+    enabled: true
+    codec: zstd
+`))
+	assert.Nil(t, err)
+
+	encryptRaw := []byte(`
+asynq:
+  encryption:
+    enabled: true
+    activeKey: k1
+    keys:
+      - id: k1
+        env: TEST_ASYNQ_KEY
+`)
+	encryptor, err := NewEncryptor(encryptRaw)
+	assert.Nil(t, err)
+
+	signRaw := []byte(`
+asynq:
+  signing:
+    enabled: true
+    activeSecret: s1
+    secrets:
+      - name: s1
+        env: TEST_ASYNQ_SECRET
+`)
+	signer, err := NewSigner(signRaw)
+	assert.Nil(t, err)
+
+	original := []byte(`{"traceHeader":{"Traceparent":["00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"]},"compression":"user field"}`)
+
+	payload, err := compressor.Compress(original)
+	assert.Nil(t, err)
+	payload, err = encryptor.Encrypt(payload)
+	assert.Nil(t, err)
+	payload, err = signer.Sign("envelope:test", payload)
+	assert.Nil(t, err)
+
+	// every envelope keeps trace header readable
+	assert.Equal(t, readTraceHeader(original), readTraceHeader(payload))
+	assert.Contains(t, string(payload), `"rkSignature"`)
+
+	compressMid, err := NewCompressionMid(nil)
+	assert.Nil(t, err)
+	encryptMid, err := NewEncryptionMid(encryptRaw)
+	assert.Nil(t, err)
+	signMid, err := NewSigningMid(signRaw)
+	assert.Nil(t, err)
+
+	var received []byte
+	h := signMid(encryptMid(compressMid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		received = t.Payload()
+		return nil
+	}))))
+
+	assert.Nil(t, h.ProcessTask(context.Background(), asynq.NewTask("envelope:test", payload)))
+	assert.Equal(t, original, received)
+
+	// user payload with field of the same name as envelope key is passed as it is
+	received = nil
+	assert.Nil(t, compressMid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		received = t.Payload()
+		return nil
+	})).ProcessTask(context.Background(), asynq.NewTask("envelope:test", original)))
+	assert.Equal(t, original, received)
+}
+
+func TestCompressionBeforeTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	RegisterSharedTrace("compression-test", sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)), nil)
+
+	traceMid, err := NewJaegerMid([]byte(`
+asynq:
+  trace:
+    enabled: true
+    shared:
+      enabled: true
+      name: compression-test
+`))
+	assert.Nil(t, err)
+
+	compressMid, err := NewCompressionMid(nil)
+	assert.Nil(t, err)
+
+	compressor, err := NewCompressor([]byte(`
+asynq:
+  compression:
+    enabled: true
+`))
+	assert.Nil(t, err)
+
+	traceId := "0af7651916cd43dd8448eb211c80319c"
+	linkedTraceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	original := []byte(`{"traceHeader":{"Traceparent":["00-` + traceId + `-b7ad6b7169203331-01"]},` +
+		`"traceLinks":[{"Traceparent":["00-` + linkedTraceId + `-00f067aa0ba902b7-01"]}]}`)
+
+	payload, err := compressor.Compress(original)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(payload), linkedTraceId)
+
+	// trace middleware and handler see decompressed payload
+	var received []byte
+	h := compressMid(traceMid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		received = t.Payload()
+		return nil
+	})))
+	assert.Nil(t, h.ProcessTask(context.Background(), asynq.NewTask("envelope:test", payload)))
+	assert.Equal(t, original, received)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, traceId, spans[0].SpanContext().TraceID().String())
+	assert.Len(t, spans[0].Links(), 1)
+	assert.Equal(t, linkedTraceId, spans[0].Links()[0].SpanContext.TraceID().String())
+}
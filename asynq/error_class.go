@@ -0,0 +1,151 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"reflect"
+	"sync"
+)
+
+const (
+	ErrorClassSkipRetry   = "skip_retry"
+	ErrorClassUndecodable = "undecodable"
+	ErrorClassRevokeTask  = "revoke_task"
+	ErrorClassDeadline    = "deadline_exceeded"
+	ErrorClassCanceled    = "canceled"
+	ErrorClassPanic       = "panic"
+	ErrorClassRescheduled = "rescheduled"
+	ErrorClassUnknown     = "unknown"
+)
+
+// ErrUndecodable is wrapped by middlewares which could not decode payload, it wraps asynq.SkipRetry
+var ErrUndecodable = fmt.Errorf("undecodable payload: %w", asynq.SkipRetry)
+
+// PanicError is returned by TraceMiddleware while handler panics
+type PanicError struct {
+	Value interface{}
+	Stack string
+}
+
+// Error returns panic value
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// IsPanic returns true if error is, or wraps PanicError
+func IsPanic(err error) bool {
+	var res *PanicError
+	return errors.As(err, &res)
+}
+
+type errorClass struct {
+	name   string
+	target error
+	typ    reflect.Type
+}
+
+var (
+	errorClassLock sync.RWMutex
+	errorClasses   = make([]*errorClass, 0)
+)
+
+// RegisterErrorClass register user defined error class matched with errors.Is(err, target).
+//
+// User defined classes are checked before built-in classes in order of registration.
+func RegisterErrorClass(name string, target error) {
+	if target != nil {
+		addErrorClass(&errorClass{name: name, target: target})
+	}
+}
+
+// RegisterErrorType register user defined error class matched if any error in chain
+// has the same type as target, for example &MyError{}.
+//
+// User defined classes are checked before built-in classes in order of registration.
+func RegisterErrorType(name string, target error) {
+	if target != nil {
+		addErrorClass(&errorClass{name: name, typ: reflect.TypeOf(target)})
+	}
+}
+
+func addErrorClass(c *errorClass) {
+	errorClassLock.Lock()
+	defer errorClassLock.Unlock()
+
+	errorClasses = append(errorClasses, c)
+}
+
+// ClassifyError returns class of error, empty string if error is nil
+func ClassifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	errorClassLock.RLock()
+	for _, c := range errorClasses {
+		if (c.target != nil && errors.Is(err, c.target)) || (c.typ != nil && errorChainHasType(err, c.typ)) {
+			errorClassLock.RUnlock()
+			return c.name
+		}
+	}
+	errorClassLock.RUnlock()
+
+	switch {
+	case IsPanic(err):
+		return ErrorClassPanic
+	case IsRescheduled(err):
+		return ErrorClassRescheduled
+	case errors.Is(err, ErrUndecodable):
+		return ErrorClassUndecodable
+	case errors.Is(err, asynq.SkipRetry):
+		return ErrorClassSkipRetry
+	case errors.Is(err, asynq.RevokeTask):
+		return ErrorClassRevokeTask
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassDeadline
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled
+	}
+
+	return ErrorClassUnknown
+}
+
+// isFinalAttempt returns true if task will not be retried with error returned by handler,
+// it is archived, or dropped by asynq.RevokeTask
+func isFinalAttempt(ctx context.Context, err error) bool {
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+
+	return finalAttempt(retried, maxRetry, err)
+}
+
+// finalAttempt is isFinalAttempt with retry counts already read from context
+func finalAttempt(retried, maxRetry int, err error) bool {
+	if err == nil || IsRescheduled(err) {
+		return false
+	}
+
+	return retried >= maxRetry || errors.Is(err, asynq.SkipRetry) || errors.Is(err, asynq.RevokeTask)
+}
+
+// ErrorChain returns messages of every error in chain, outermost first
+func ErrorChain(err error) []string {
+	res := make([]string, 0)
+	for ; err != nil; err = errors.Unwrap(err) {
+		res = append(res, fmt.Sprintf("%T: %v", err, err))
+	}
+
+	return res
+}
+
+func errorChainHasType(err error, typ reflect.Type) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if reflect.TypeOf(err) == typ {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,104 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// testClassError is registered as user defined error type
+type testClassError struct{}
+
+func (e *testClassError) Error() string {
+	return "test class error"
+}
+
+func TestClassifyError(t *testing.T) {
+	errTarget := errors.New("test class target")
+	RegisterErrorClass("test_target", errTarget)
+	RegisterErrorType("test_type", &testClassError{})
+
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"Nil", nil, ""},
+		{"Target", fmt.Errorf("wrapped: %w", errTarget), "test_target"},
+		{"Type", fmt.Errorf("wrapped: %w", &testClassError{}), "test_type"},
+		{"UserBeforeBuiltIn", fmt.Errorf("%w: %w", errTarget, asynq.SkipRetry), "test_target"},
+		{"Panic", &PanicError{Value: "boom"}, ErrorClassPanic},
+		{"Rescheduled", Reschedule("throttled", time.Second), ErrorClassRescheduled},
+		{"Undecodable", fmt.Errorf("decode failed: %w", ErrUndecodable), ErrorClassUndecodable},
+		{"SkipRetry", fmt.Errorf("invalid: %w", asynq.SkipRetry), ErrorClassSkipRetry},
+		{"RevokeTask", fmt.Errorf("gone: %w", asynq.RevokeTask), ErrorClassRevokeTask},
+		{"Deadline", fmt.Errorf("slow: %w", context.DeadlineExceeded), ErrorClassDeadline},
+		{"Canceled", context.Canceled, ErrorClassCanceled},
+		{"Unknown", errors.New("unknown"), ErrorClassUnknown},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, ClassifyError(c.err))
+		})
+	}
+
+	// nil target is ignored
+	RegisterErrorClass("test_nil", nil)
+	assert.Equal(t, ErrorClassUnknown, ClassifyError(errors.New("unknown")))
+}
+
+func TestFinalAttempt(t *testing.T) {
+	cases := []struct {
+		name     string
+		retried  int
+		maxRetry int
+		err      error
+		want     bool
+	}{
+		{"Nil", 3, 3, nil, false},
+		{"Retrying", 1, 3, errors.New("failed"), false},
+		{"Exhausted", 3, 3, errors.New("failed"), true},
+		{"SkipRetry", 0, 3, fmt.Errorf("invalid: %w", asynq.SkipRetry), true},
+		{"RevokeTask", 0, 3, asynq.RevokeTask, true},
+		{"Rescheduled", 3, 3, Reschedule("throttled", time.Second), false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, finalAttempt(c.retried, c.maxRetry, c.err))
+		})
+	}
+}
+
+func TestRecordTaskError(t *testing.T) {
+	cases := []struct {
+		name  string
+		err   error
+		class string
+		final string
+	}{
+		// no retry count in context, which is the final attempt
+		{"Final", errors.New("failed"), ErrorClassUnknown, "true"},
+		{"Rescheduled", Reschedule("throttled", time.Second), ErrorClassRescheduled, "false"},
+		{"Panic", &PanicError{Value: "boom", Stack: "stack"}, ErrorClassPanic, "true"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, end := newRecordedContext()
+			recordTaskError(ctx, GetSpan(ctx), c.err)
+			span := end()
+
+			assert.Equal(t, c.class, spanAttribute(span, "asynq.error.class"))
+			assert.Equal(t, "0", spanAttribute(span, "asynq.task.retried"))
+			assert.Equal(t, "0", spanAttribute(span, "asynq.task.maxRetry"))
+			assert.Equal(t, c.final, spanAttribute(span, "asynq.task.finalAttempt"))
+			assert.True(t, hasEvent(span, "exception"))
+		})
+	}
+}
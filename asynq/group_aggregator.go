@@ -0,0 +1,108 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+const traceLinksField = "traceLinks"
+
+// AggregateFunc builds type, payload and options of aggregated task from member tasks.
+//
+// Payload should be a JSON object, ctx carries span of aggregation.
+type AggregateFunc func(ctx context.Context, group string, tasks []*asynq.Task) (typeName string, payload []byte, opts []asynq.Option)
+
+// NewTracedAggregator create asynq.GroupAggregator which keeps traces of member tasks.
+//
+// A new trace is started for aggregation with span links to every member trace,
+// trace header of aggregated task is replaced with the new trace, and member trace headers are written into
+// traceLinks field, so that TraceMiddleware links span of aggregated task to every member trace as well.
+// Tracer and propagator are taken from shared trace with traceName, see GetSharedTrace.
+func NewTracedAggregator(traceName string, fn AggregateFunc) (asynq.GroupAggregator, error) {
+	shared, err := GetSharedTrace(traceName)
+	if err != nil {
+		return nil, err
+	}
+
+	propagator := shared.Propagator
+	if propagator == nil {
+		propagator = newDefaultPropagator()
+	}
+
+	tracer := shared.Provider.Tracer("rk-asynq-aggregator")
+
+	return asynq.GroupAggregatorFunc(func(group string, tasks []*asynq.Task) *asynq.Task {
+		headers := make([]http.Header, 0, len(tasks))
+		links := make([]oteltrace.Link, 0, len(tasks))
+
+		for _, t := range tasks {
+			var p basePayload
+			if err := json.Unmarshal(t.Payload(), &p); err != nil || len(p.TraceHeader) < 1 {
+				continue
+			}
+
+			spanCtx := oteltrace.SpanContextFromContext(
+				propagator.Extract(context.Background(), propagation.HeaderCarrier(p.TraceHeader)))
+			if !spanCtx.IsValid() {
+				continue
+			}
+
+			headers = append(headers, p.TraceHeader)
+			links = append(links, oteltrace.Link{
+				SpanContext: spanCtx,
+				Attributes:  []attribute.KeyValue{attribute.String("asynq.task.type", t.Type())},
+			})
+		}
+
+		ctx, span := tracer.Start(context.Background(), fmt.Sprintf("aggregate %s", group),
+			oteltrace.WithNewRoot(),
+			oteltrace.WithSpanKind(oteltrace.SpanKindProducer),
+			oteltrace.WithLinks(links...),
+			oteltrace.WithAttributes(
+				attribute.String("asynq.group", group),
+				attribute.Int("asynq.group.size", len(tasks)),
+			))
+		defer span.End()
+
+		ctx = context.WithValue(ctx, spanKey, span)
+		ctx = context.WithValue(ctx, tracerKey, tracer)
+		ctx = context.WithValue(ctx, propagatorKey, propagator)
+
+		typeName, payload, opts := fn(ctx, group, tasks)
+
+		// payload is kept untouched if failed to inject, trace is lost but tasks are not
+		payload, err := injectTraceLinks(ctx, payload, headers)
+		if err != nil {
+			span.RecordError(err)
+		}
+
+		return asynq.NewTask(typeName, payload, opts...)
+	}), nil
+}
+
+// injectTraceLinks replace trace header with the one of ctx and write member trace headers into payload
+func injectTraceLinks(ctx context.Context, payload []byte, headers []http.Header) ([]byte, error) {
+	res, err := InjectTraceHeader(ctx, payload)
+	if err != nil {
+		return payload, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(res, &fields); err != nil {
+		return payload, err
+	}
+
+	raw, err := json.Marshal(headers)
+	if err != nil {
+		return payload, err
+	}
+	fields[traceLinksField] = raw
+
+	return json.Marshal(fields)
+}
@@ -0,0 +1,82 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"testing"
+)
+
+func TestNewTracedAggregator(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	RegisterSharedTrace("aggregator-test", provider, nil)
+
+	// member tasks from different traces, and one without trace header
+	members := make([]*asynq.Task, 0)
+	memberTraces := make([]oteltrace.TraceID, 0)
+	for i := 0; i < 3; i++ {
+		ctx, span := provider.Tracer("test").Start(context.Background(), "producer")
+		task, err := NewTracedTask(ctx, "email:send", []byte(`{}`))
+		assert.Nil(t, err)
+		span.End()
+
+		members = append(members, task)
+		memberTraces = append(memberTraces, span.SpanContext().TraceID())
+	}
+	members = append(members, asynq.NewTask("email:send", []byte(`{}`)))
+
+	aggregator, err := NewTracedAggregator("aggregator-test", func(ctx context.Context, group string, tasks []*asynq.Task) (string, []byte, []asynq.Option) {
+		payload, _ := json.Marshal(map[string]int{"count": len(tasks)})
+		return "email:batch", payload, nil
+	})
+	assert.Nil(t, err)
+
+	offset := len(recorder.Ended())
+	aggregated := aggregator.Aggregate("emails", members)
+	assert.Equal(t, "email:batch", aggregated.Type())
+	assert.Contains(t, string(aggregated.Payload()), `"count":4`)
+	assert.Len(t, readTraceLinks(aggregated.Payload()), 3)
+
+	spans := recorder.Ended()[offset:]
+	assert.Len(t, spans, 1)
+	aggregation := spans[0]
+	assert.Equal(t, "aggregate emails", aggregation.Name())
+	assert.Len(t, aggregation.Links(), 3)
+	for i, link := range aggregation.Links() {
+		assert.Equal(t, memberTraces[i], link.SpanContext.TraceID())
+		assert.NotEqual(t, aggregation.SpanContext().TraceID(), link.SpanContext.TraceID())
+	}
+
+	// consumer span continues aggregation trace and links every member trace
+	mid, err := NewJaegerMid([]byte(`
+asynq:
+  trace:
+    enabled: true
+    shared:
+      enabled: true
+      name: aggregator-test
+`))
+	assert.Nil(t, err)
+
+	offset = len(recorder.Ended())
+	h := mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error { return nil }))
+	assert.Nil(t, h.ProcessTask(context.Background(), aggregated))
+
+	spans = recorder.Ended()[offset:]
+	assert.Len(t, spans, 1)
+	assert.Equal(t, aggregation.SpanContext().TraceID(), spans[0].SpanContext().TraceID())
+	assert.Len(t, spans[0].Links(), 3)
+	for i, link := range spans[0].Links() {
+		assert.Equal(t, memberTraces[i], link.SpanContext.TraceID())
+	}
+}
+
+func TestNewTracedAggregator_UnknownTrace(t *testing.T) {
+	_, err := NewTracedAggregator("not-registered", nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,90 @@
+package rkasynq
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hibiken/asynq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+// newTestRedis returns connection option and client of in-process redis closed with test
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, asynq.RedisConnOpt, redis.UniversalClient) {
+	mr := miniredis.RunT(t)
+	opt := asynq.RedisClientOpt{Addr: mr.Addr()}
+
+	client, err := NewRedisClient(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return mr, opt, client
+}
+
+// counterValue returns value of counter with label values, zero if not registered
+func counterValue(name string, labelValues ...string) float64 {
+	if metricsSet.GetCounter(name) == nil {
+		return 0
+	}
+
+	counter := metricsSet.GetCounterWithValues(name, labelValues...)
+	if counter == nil {
+		return 0
+	}
+
+	return testutil.ToFloat64(counter)
+}
+
+// gaugeValue returns value of gauge with label values, zero if not registered
+func gaugeValue(name string, labelValues ...string) float64 {
+	if metricsSet.GetGauge(name) == nil {
+		return 0
+	}
+
+	gauge := metricsSet.GetGaugeWithValues(name, labelValues...)
+	if gauge == nil {
+		return 0
+	}
+
+	return testutil.ToFloat64(gauge)
+}
+
+// newRecordedContext returns context carrying span as TraceMiddleware does, span is ended by end
+func newRecordedContext() (ctx context.Context, end func() sdktrace.ReadOnlySpan) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	ctx, span := provider.Tracer("test").Start(context.Background(), "test")
+	ctx = context.WithValue(ctx, spanKey, span)
+
+	return ctx, func() sdktrace.ReadOnlySpan {
+		span.End()
+		return recorder.Ended()[0]
+	}
+}
+
+// hasEvent returns true if span has event with name
+func hasEvent(span sdktrace.ReadOnlySpan, name string) bool {
+	for _, e := range span.Events() {
+		if e.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// spanAttribute returns value of attribute as string, empty if missing
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) string {
+	for _, kv := range span.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value.Emit()
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,261 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultBridgeMaxBodyBytes = 1 << 20
+
+// BridgeConfig maps HTTP routes to asynq tasks.
+//
+// JSON body should be an object which is used as payload directly,
+// or placed under payloadField if configured. Trace of incoming request is injected into traceHeader.
+// Tracer and propagator are taken from shared trace with traceName, see RegisterSharedTrace,
+// otel global ones are used if traceName is empty.
+//
+// Example:
+//
+//	asynq:
+//	  bridge:
+//	    enabled: true
+//	    traceName: ""
+//	    maxBodyBytes: 1048576
+//	    routes:
+//	      - method: POST
+//	        path: /webhooks/github
+//	        taskType: github:event
+//	        payloadField: event
+//	        queue: default
+//	        maxRetry: 3
+//	        timeout: 30s
+type BridgeConfig struct {
+	Asynq struct {
+		Bridge struct {
+			Enabled      bool   `yaml:"enabled" json:"enabled"`
+			TraceName    string `yaml:"traceName" json:"traceName"`
+			MaxBodyBytes int64  `yaml:"maxBodyBytes" json:"maxBodyBytes"`
+			Routes       []struct {
+				Method       string `yaml:"method" json:"method"`
+				Path         string `yaml:"path" json:"path"`
+				TaskType     string `yaml:"taskType" json:"taskType"`
+				PayloadField string `yaml:"payloadField" json:"payloadField"`
+				Queue        string `yaml:"queue" json:"queue"`
+				MaxRetry     int    `yaml:"maxRetry" json:"maxRetry"`
+				Timeout      string `yaml:"timeout" json:"timeout"`
+			} `yaml:"routes" json:"routes"`
+		} `yaml:"bridge" json:"bridge"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// BridgeResponse is returned to HTTP caller once task is enqueued
+type BridgeResponse struct {
+	TaskId   string `json:"taskId,omitempty"`
+	TaskType string `json:"taskType,omitempty"`
+	Queue    string `json:"queue,omitempty"`
+	TraceId  string `json:"traceId,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// NewBridgeHandler create http.Handler which enqueues tasks with client and continues incoming trace.
+func NewBridgeHandler(raw []byte, client *asynq.Client) (http.Handler, error) {
+	conf := &BridgeConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	c := conf.Asynq.Bridge
+
+	shared, err := GetSharedTrace(c.TraceName)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := &BridgeHandler{
+		enabled:      c.Enabled,
+		client:       client,
+		tracer:       shared.Provider.Tracer("rk-asynq-bridge"),
+		propagator:   shared.Propagator,
+		maxBodyBytes: c.MaxBodyBytes,
+		routes:       map[string]*bridgeRoute{},
+	}
+
+	if handler.propagator == nil {
+		handler.propagator = newDefaultPropagator()
+	}
+
+	if handler.maxBodyBytes <= 0 {
+		handler.maxBodyBytes = defaultBridgeMaxBodyBytes
+	}
+
+	for _, v := range c.Routes {
+		if len(v.Path) < 1 || len(v.TaskType) < 1 {
+			return nil, fmt.Errorf("path and taskType of bridge route are required")
+		}
+
+		route := &bridgeRoute{
+			method:       strings.ToUpper(v.Method),
+			path:         v.Path,
+			taskType:     v.TaskType,
+			payloadField: v.PayloadField,
+			opts:         make([]asynq.Option, 0),
+		}
+
+		if len(route.method) < 1 {
+			route.method = http.MethodPost
+		}
+
+		if len(v.Queue) > 0 {
+			route.opts = append(route.opts, asynq.Queue(v.Queue))
+		}
+
+		if v.MaxRetry > 0 {
+			route.opts = append(route.opts, asynq.MaxRetry(v.MaxRetry))
+		}
+
+		if len(v.Timeout) > 0 {
+			d, err := time.ParseDuration(v.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timeout of bridge route %s: %v", v.Path, err)
+			}
+			route.opts = append(route.opts, asynq.Timeout(d))
+		}
+
+		handler.routes[route.method+" "+route.path] = route
+	}
+
+	return handler, nil
+}
+
+type bridgeRoute struct {
+	method       string
+	path         string
+	taskType     string
+	payloadField string
+	opts         []asynq.Option
+}
+
+// BridgeHandler implementation of http.Handler
+type BridgeHandler struct {
+	enabled      bool
+	client       *asynq.Client
+	tracer       oteltrace.Tracer
+	propagator   propagation.TextMapPropagator
+	maxBodyBytes int64
+	routes       map[string]*bridgeRoute
+}
+
+// ServeHTTP enqueue task mapped from route and body, returns BridgeResponse
+func (b *BridgeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, ok := b.routes[r.Method+" "+r.URL.Path]
+	if !b.enabled || !ok {
+		writeBridgeResponse(w, http.StatusNotFound, &BridgeResponse{Error: "route not found"})
+		return
+	}
+
+	ctx := b.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := b.tracer.Start(ctx, fmt.Sprintf("HTTP %s %s", route.method, route.path),
+		oteltrace.WithSpanKind(oteltrace.SpanKindServer),
+		oteltrace.WithAttributes(
+			semconv.HTTPMethod(r.Method),
+			semconv.HTTPRoute(route.path),
+			attribute.String("asynq.task.type", route.taskType),
+		))
+	defer span.End()
+
+	// propagator of bridge is used while injecting trace header into payload
+	ctx = context.WithValue(ctx, propagatorKey, b.propagator)
+
+	resp := &BridgeResponse{
+		TaskType: route.taskType,
+		TraceId:  span.SpanContext().TraceID().String(),
+	}
+
+	status, err := b.enqueue(ctx, r, route, resp)
+	span.SetAttributes(semconv.HTTPStatusCode(status))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		resp.Error = err.Error()
+	} else {
+		span.SetAttributes(
+			attribute.String("asynq.task.id", resp.TaskId),
+			attribute.String("asynq.queue", resp.Queue))
+		span.SetStatus(codes.Ok, "success")
+	}
+
+	writeBridgeResponse(w, status, resp)
+}
+
+func (b *BridgeHandler) enqueue(ctx context.Context, r *http.Request, route *bridgeRoute, resp *BridgeResponse) (int, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, b.maxBodyBytes+1))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if int64(len(body)) > b.maxBodyBytes {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %d bytes", b.maxBodyBytes)
+	}
+
+	payload, err := bridgePayload(body, route.payloadField)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	task, err := NewTracedTask(ctx, route.taskType, payload, route.opts...)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	info, err := b.client.EnqueueContext(ctx, task)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	resp.TaskId = info.ID
+	resp.Queue = info.Queue
+
+	return http.StatusAccepted, nil
+}
+
+// bridgePayload validates body is JSON and wraps it with field if provided
+func bridgePayload(body []byte, field string) ([]byte, error) {
+	if len(field) > 0 {
+		if len(body) < 1 {
+			body = []byte("null")
+		}
+		if !json.Valid(body) {
+			return nil, fmt.Errorf("body is not a valid JSON")
+		}
+		return json.Marshal(map[string]json.RawMessage{field: body})
+	}
+
+	if len(body) < 1 {
+		return []byte("{}"), nil
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, fmt.Errorf("body is not a JSON object: %v", err)
+	}
+
+	return body, nil
+}
+
+func writeBridgeResponse(w http.ResponseWriter, status int, resp *BridgeResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
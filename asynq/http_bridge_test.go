@@ -0,0 +1,121 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const bridgeTestConfig = `
+asynq:
+  bridge:
+    enabled: true
+    traceName: bridge-test
+    maxBodyBytes: 32
+    routes:
+      - path: /webhooks/github
+        taskType: github:event
+        payloadField: event
+        queue: webhooks
+`
+
+func serveBridge(h http.Handler, method, path, body string, header http.Header) (int, *BridgeResponse) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	resp := &BridgeResponse{}
+	json.Unmarshal(rec.Body.Bytes(), resp)
+
+	return rec.Code, resp
+}
+
+func TestBridgeHandler(t *testing.T) {
+	_, opt, _ := newTestRedis(t)
+
+	client := asynq.NewClient(opt)
+	defer client.Close()
+	inspector := asynq.NewInspector(opt)
+	defer inspector.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	RegisterSharedTrace("bridge-test", sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)), propagation.TraceContext{})
+
+	h, err := NewBridgeHandler([]byte(bridgeTestConfig), client)
+	assert.Nil(t, err)
+
+	// incoming trace is continued and injected into enqueued task
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	header := http.Header{}
+	header.Set("Traceparent", "00-"+traceId+"-00f067aa0ba902b7-01")
+
+	status, resp := serveBridge(h, http.MethodPost, "/webhooks/github", `{"action":"push"}`, header)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, traceId, resp.TraceId)
+	assert.Equal(t, "github:event", resp.TaskType)
+	assert.Equal(t, "webhooks", resp.Queue)
+	assert.NotEmpty(t, resp.TaskId)
+
+	info, err := inspector.GetTaskInfo("webhooks", resp.TaskId)
+	assert.Nil(t, err)
+	assert.Contains(t, string(info.Payload), `"event":{"action":"push"}`)
+
+	carrier := propagation.HeaderCarrier(readTraceHeader(info.Payload))
+	taskCtx := oteltrace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), carrier))
+	assert.Equal(t, traceId, taskCtx.TraceID().String())
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, oteltrace.SpanKindServer, spans[0].SpanKind())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+	assert.Equal(t, spans[0].SpanContext().SpanID(), taskCtx.SpanID())
+
+	// unknown route
+	status, resp = serveBridge(h, http.MethodGet, "/webhooks/github", "", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.NotEmpty(t, resp.Error)
+
+	// body too large
+	status, resp = serveBridge(h, http.MethodPost, "/webhooks/github", `{"action":"`+strings.Repeat("x", 32)+`"}`, nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.NotEmpty(t, resp.Error)
+
+	// invalid body
+	status, resp = serveBridge(h, http.MethodPost, "/webhooks/github", `{"action"`, nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.NotEmpty(t, resp.Error)
+
+	tasks, err := inspector.ListPendingTasks("webhooks")
+	assert.Nil(t, err)
+	assert.Len(t, tasks, 1)
+}
+
+func TestNewBridgeHandler_InvalidConfig(t *testing.T) {
+	_, err := NewBridgeHandler([]byte(`
+asynq:
+  bridge:
+    routes:
+      - path: /missing-type
+`), nil)
+	assert.NotNil(t, err)
+
+	_, err = NewBridgeHandler([]byte(`
+asynq:
+  bridge:
+    traceName: not-registered
+`), nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,93 @@
+package rkasynq
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+const urlTemplateKey = "URLTemplateKey"
+
+// WithURLTemplate returns context with URL template, for example /v1/users/{id},
+// which is used as span name and attribute instead of raw path by TracedTransport.
+func WithURLTemplate(ctx context.Context, template string) context.Context {
+	return context.WithValue(ctx, urlTemplateKey, template)
+}
+
+// NewTracedTransport wrap http.RoundTripper, http.DefaultTransport is used if base is nil.
+//
+// Requests created with context of task handler start CLIENT span under task span,
+// and trace header is injected with propagator of TraceMiddleware.
+//
+// Example:
+//
+//	client := &http.Client{Transport: rkasynq.NewTracedTransport(nil)}
+//	req, _ := http.NewRequestWithContext(rkasynq.WithURLTemplate(ctx, "/v1/users/{id}"), http.MethodGet, url, nil)
+//	resp, err := client.Do(req)
+func NewTracedTransport(base http.RoundTripper) *TracedTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &TracedTransport{
+		base: base,
+	}
+}
+
+// TracedTransport implementation of http.RoundTripper
+type TracedTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip start CLIENT span, inject trace header and record response status
+func (t *TracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	template := req.URL.Path
+	if v, ok := ctx.Value(urlTemplateKey).(string); ok && len(v) > 0 {
+		template = v
+	}
+
+	ctx, span := GetTracer(ctx).Start(ctx, fmt.Sprintf("HTTP %s %s", req.Method, template),
+		oteltrace.WithSpanKind(oteltrace.SpanKindClient),
+		oteltrace.WithAttributes(
+			semconv.HTTPMethod(req.Method),
+			semconv.HTTPURL(redactURL(req)),
+			attribute.String("url.template", template),
+			semconv.NetPeerName(req.URL.Hostname()),
+		))
+	defer span.End()
+
+	// RoundTripper should not modify the original request
+	req = req.Clone(ctx)
+	getPropagatorOrDefault(ctx).Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	} else {
+		span.SetStatus(codes.Ok, http.StatusText(resp.StatusCode))
+	}
+
+	return resp, nil
+}
+
+// redactURL returns URL without user info
+func redactURL(req *http.Request) string {
+	u := *req.URL
+	u.User = nil
+
+	return u.String()
+}
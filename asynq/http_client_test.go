@@ -0,0 +1,86 @@
+package rkasynq
+
+import (
+	"context"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTracedTransport(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	RegisterSharedTrace("http-client-test", sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)), nil)
+
+	mid, err := NewJaegerMid([]byte(`
+asynq:
+  trace:
+    enabled: true
+    shared:
+      enabled: true
+      name: http-client-test
+`))
+	assert.Nil(t, err)
+
+	client := &http.Client{Transport: NewTracedTransport(nil)}
+	get := func(ctx context.Context, url string) int {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		assert.Nil(t, err)
+
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	h := mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		get(WithURLTemplate(ctx, "/v1/users/{id}"), server.URL+"/v1/users/1")
+		return nil
+	}))
+	assert.Nil(t, h.ProcessTask(context.Background(), asynq.NewTask("http:test", []byte(`{}`))))
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	clientSpan, taskSpan := spans[0], spans[1]
+
+	// CLIENT span is child of task span and its context is injected into request
+	assert.Equal(t, "HTTP GET /v1/users/{id}", clientSpan.Name())
+	assert.Equal(t, oteltrace.SpanKindClient, clientSpan.SpanKind())
+	assert.Equal(t, taskSpan.SpanContext().SpanID(), clientSpan.Parent().SpanID())
+	assert.Equal(t, "200", spanAttribute(clientSpan, "http.status_code"))
+	assert.Equal(t, codes.Ok, clientSpan.Status().Code)
+
+	injected := oteltrace.SpanContextFromContext(
+		propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(received)))
+	assert.Equal(t, clientSpan.SpanContext().TraceID(), injected.TraceID())
+	assert.Equal(t, clientSpan.SpanContext().SpanID(), injected.SpanID())
+
+	// raw path is used without template, user info is redacted and error status is recorded
+	h = mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		get(ctx, strings.Replace(server.URL, "http://", "http://user:secret@", 1)+"/missing")
+		return nil
+	}))
+	assert.Nil(t, h.ProcessTask(context.Background(), asynq.NewTask("http:test", []byte(`{}`))))
+
+	clientSpan = recorder.Ended()[2]
+	assert.Equal(t, "HTTP GET /missing", clientSpan.Name())
+	assert.Equal(t, codes.Error, clientSpan.Status().Code)
+	assert.NotContains(t, spanAttribute(clientSpan, "http.url"), "secret")
+}
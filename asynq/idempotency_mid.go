@@ -0,0 +1,234 @@
+package rkasynq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+	"strings"
+	"time"
+)
+
+const (
+	defaultIdempotencyKeyPrefix = "rk:asynq:idempotency:"
+	defaultIdempotencyTTL       = 24 * time.Hour
+)
+
+// IdempotencyConfig defines how idempotency key is derived.
+//
+// Task ID is used as key by default, tasks listed in keyFields use value of payload field instead.
+// Nested field could be referenced with dot, for example order.id.
+//
+// Example:
+//
+//	asynq:
+//	  idempotency:
+//	    enabled: true
+//	    ttl: 24h
+//	    keyFields:
+//	      order:create: order.id
+type IdempotencyConfig struct {
+	Asynq struct {
+		Idempotency struct {
+			Enabled   bool              `yaml:"enabled" json:"enabled"`
+			TTL       string            `yaml:"ttl" json:"ttl"`
+			KeyPrefix string            `yaml:"keyPrefix" json:"keyPrefix"`
+			KeyFields map[string]string `yaml:"keyFields" json:"keyFields"`
+		} `yaml:"idempotency" json:"idempotency"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// IdempotencyStore records completion of tasks
+type IdempotencyStore interface {
+	IsDone(ctx context.Context, key string) (bool, error)
+
+	MarkDone(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// IdempotencyOption is used while creating IdempotencyMiddleware
+type IdempotencyOption func(*IdempotencyMiddleware)
+
+// WithIdempotencyStore use store instead of redis dialed with redisOpt
+func WithIdempotencyStore(store IdempotencyStore) IdempotencyOption {
+	return func(m *IdempotencyMiddleware) {
+		m.store = store
+	}
+}
+
+// WithIdempotencyRedisClient use client instead of the one dialed with redisOpt
+func WithIdempotencyRedisClient(client redis.UniversalClient) IdempotencyOption {
+	return func(m *IdempotencyMiddleware) {
+		m.store = NewRedisIdempotencyStore(client, m.keyPrefix)
+	}
+}
+
+// NewIdempotencyMid create middleware which skips tasks already processed successfully.
+//
+// Pass the same redisOpt used by asynq.Server, redisOpt is not used if store is provided with options.
+func NewIdempotencyMid(raw []byte, redisOpt asynq.RedisConnOpt, opts ...IdempotencyOption) (asynq.MiddlewareFunc, error) {
+	conf := &IdempotencyConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	mid := &IdempotencyMiddleware{
+		enabled:   conf.Asynq.Idempotency.Enabled,
+		ttl:       defaultIdempotencyTTL,
+		keyFields: conf.Asynq.Idempotency.KeyFields,
+		keyPrefix: conf.Asynq.Idempotency.KeyPrefix,
+	}
+
+	if len(conf.Asynq.Idempotency.TTL) > 0 {
+		ttl, err := time.ParseDuration(conf.Asynq.Idempotency.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid idempotency ttl: %v", err)
+		}
+		mid.ttl = ttl
+	}
+
+	for i := range opts {
+		opts[i](mid)
+	}
+
+	if mid.enabled && mid.store == nil {
+		client, err := NewRedisClient(redisOpt)
+		if err != nil {
+			return nil, err
+		}
+		mid.store = NewRedisIdempotencyStore(client, mid.keyPrefix)
+	}
+
+	return mid.Middleware, nil
+}
+
+type IdempotencyMiddleware struct {
+	enabled   bool
+	ttl       time.Duration
+	keyFields map[string]string
+	keyPrefix string
+	store     IdempotencyStore
+}
+
+func (m *IdempotencyMiddleware) Middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if !m.enabled {
+			return h.ProcessTask(ctx, t)
+		}
+
+		key := m.key(ctx, t)
+		if len(key) < 1 {
+			return h.ProcessTask(ctx, t)
+		}
+
+		span := GetSpan(ctx)
+		span.SetAttributes(attribute.String("asynq.idempotency.key", key))
+
+		done, err := m.store.IsDone(ctx, key)
+		if err != nil {
+			// fail open, task might be processed twice which is the same as without middleware
+			span.RecordError(err)
+		}
+
+		if done {
+			span.AddEvent("duplicate_skipped", oteltrace.WithAttributes(
+				attribute.String("asynq.task.type", t.Type()),
+				attribute.String("asynq.idempotency.key", key),
+			))
+			incCounter("idempotency_duplicate_total", []string{"type"}, t.Type())
+			return nil
+		}
+
+		if err := h.ProcessTask(ctx, t); err != nil {
+			return err
+		}
+
+		if err := m.store.MarkDone(ctx, key, m.ttl); err != nil {
+			span.RecordError(err)
+		}
+
+		return nil
+	})
+}
+
+// key returns payload field value if configured, otherwise task ID
+func (m *IdempotencyMiddleware) key(ctx context.Context, t *asynq.Task) string {
+	if field, ok := m.keyFields[t.Type()]; ok {
+		if v, ok := lookupPayloadField(t.Payload(), field); ok {
+			return t.Type() + ":" + v
+		}
+	}
+
+	if id, ok := asynq.GetTaskID(ctx); ok {
+		return t.Type() + ":" + id
+	}
+
+	return ""
+}
+
+// lookupPayloadField returns string value of field in JSON payload, nested field separated by dot
+func lookupPayloadField(payload []byte, field string) (string, bool) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return "", false
+	}
+
+	for _, k := range strings.Split(field, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[k]; !ok || v == nil {
+			return "", false
+		}
+	}
+
+	switch res := v.(type) {
+	case string:
+		return res, true
+	case json.Number:
+		return res.String(), true
+	case bool:
+		return fmt.Sprintf("%v", res), true
+	}
+
+	return "", false
+}
+
+// ***************** Redis *****************
+
+// NewRedisIdempotencyStore create IdempotencyStore with redis
+func NewRedisIdempotencyStore(client redis.UniversalClient, keyPrefix string) IdempotencyStore {
+	if len(keyPrefix) < 1 {
+		keyPrefix = defaultIdempotencyKeyPrefix
+	}
+
+	return &redisIdempotencyStore{
+		client:    client,
+		keyPrefix: keyPrefix,
+	}
+}
+
+type redisIdempotencyStore struct {
+	client    redis.UniversalClient
+	keyPrefix string
+}
+
+func (s *redisIdempotencyStore) IsDone(ctx context.Context, key string) (bool, error) {
+	res, err := s.client.Exists(ctx, s.keyPrefix+key).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return res > 0, nil
+}
+
+func (s *redisIdempotencyStore) MarkDone(ctx context.Context, key string, ttl time.Duration) error {
+	return s.client.Set(ctx, s.keyPrefix+key, time.Now().UTC().Format(time.RFC3339), ttl).Err()
+}
@@ -0,0 +1,151 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newTestIdempotencyMid(t *testing.T) (asynq.MiddlewareFunc, *IdempotencyMiddleware) {
+	_, _, client := newTestRedis(t)
+
+	raw := []byte(`
+asynq:
+  idempotency:
+    enabled: true
+    ttl: 1h
+    keyFields:
+      order:create: order.id
+      order:pay: amount
+`)
+
+	var mid *IdempotencyMiddleware
+	res, err := NewIdempotencyMid(raw, nil, WithIdempotencyRedisClient(client), func(m *IdempotencyMiddleware) {
+		mid = m
+	})
+	assert.Nil(t, err)
+
+	return res, mid
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	mid, m := newTestIdempotencyMid(t)
+
+	calls := 0
+	h := mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		calls++
+		return nil
+	}))
+
+	task := asynq.NewTask("order:create", []byte(`{"order":{"id":"o-1"}}`))
+
+	// first run is marked done
+	ctx, end := newRecordedContext()
+	assert.Nil(t, h.ProcessTask(ctx, task))
+	span := end()
+	assert.Equal(t, 1, calls)
+	assert.False(t, hasEvent(span, "duplicate_skipped"))
+	assert.Equal(t, "order:create:o-1", spanAttribute(span, "asynq.idempotency.key"))
+
+	done, err := m.store.IsDone(context.Background(), "order:create:o-1")
+	assert.Nil(t, err)
+	assert.True(t, done)
+
+	// duplicate is skipped
+	before := counterValue("idempotency_duplicate_total", "order:create")
+
+	ctx, end = newRecordedContext()
+	assert.Nil(t, h.ProcessTask(ctx, task))
+	span = end()
+	assert.Equal(t, 1, calls)
+	assert.True(t, hasEvent(span, "duplicate_skipped"))
+	assert.Equal(t, before+1, counterValue("idempotency_duplicate_total", "order:create"))
+}
+
+func TestIdempotencyMiddleware_Failed(t *testing.T) {
+	mid, m := newTestIdempotencyMid(t)
+
+	calls := 0
+	h := mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		calls++
+		return errors.New("failed")
+	}))
+
+	task := asynq.NewTask("order:create", []byte(`{"order":{"id":"o-2"}}`))
+
+	assert.NotNil(t, h.ProcessTask(context.Background(), task))
+	assert.NotNil(t, h.ProcessTask(context.Background(), task))
+	assert.Equal(t, 2, calls)
+
+	done, err := m.store.IsDone(context.Background(), "order:create:o-2")
+	assert.Nil(t, err)
+	assert.False(t, done)
+}
+
+func TestIdempotencyMiddleware_NoKey(t *testing.T) {
+	mid, _ := newTestIdempotencyMid(t)
+
+	calls := 0
+	h := mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		calls++
+		return nil
+	}))
+
+	// neither key field nor task ID outside asynq server
+	task := asynq.NewTask("order:create", []byte(`{"order":{}}`))
+	assert.Nil(t, h.ProcessTask(context.Background(), task))
+	assert.Nil(t, h.ProcessTask(context.Background(), task))
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotencyMiddleware_Store(t *testing.T) {
+	_, _, client := newTestRedis(t)
+	store := NewRedisIdempotencyStore(client, "custom:")
+
+	raw := []byte(`
+asynq:
+  idempotency:
+    enabled: true
+    keyFields:
+      order:pay: amount
+`)
+
+	mid, err := NewIdempotencyMid(raw, nil, WithIdempotencyStore(store))
+	assert.Nil(t, err)
+
+	h := mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		return nil
+	}))
+
+	assert.Nil(t, h.ProcessTask(context.Background(), asynq.NewTask("order:pay", []byte(`{"amount":12345678901234567890}`))))
+	assert.Equal(t, int64(1), client.Exists(context.Background(), "custom:order:pay:12345678901234567890").Val())
+}
+
+func TestLookupPayloadField(t *testing.T) {
+	payload := []byte(`{"id":"a","n":12345678901234567890,"f":1.5,"b":true,"order":{"id":7,"user":{"name":"x"}},"nil":null,"arr":[1]}`)
+
+	cases := map[string]string{
+		"id":              "a",
+		"n":               "12345678901234567890",
+		"f":               "1.5",
+		"b":               "true",
+		"order.id":        "7",
+		"order.user.name": "x",
+	}
+
+	for field, expected := range cases {
+		v, ok := lookupPayloadField(payload, field)
+		assert.True(t, ok, field)
+		assert.Equal(t, expected, v, field)
+	}
+
+	for _, field := range []string{"missing", "nil", "arr", "order", "order.missing", "id.x"} {
+		_, ok := lookupPayloadField(payload, field)
+		assert.False(t, ok, field)
+	}
+
+	_, ok := lookupPayloadField([]byte("not json"), "id")
+	assert.False(t, ok)
+}
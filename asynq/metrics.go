@@ -0,0 +1,37 @@
+package rkasynq
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	rkmidprom "github.com/rookie-ninja/rk-entry/v2/middleware/prom"
+)
+
+var metricsSet = rkmidprom.NewMetricsSet("rk", "asynq", prometheus.DefaultRegisterer)
+
+// GetMetricsSet returns metrics set shared by middlewares in this package,
+// metrics are registered into prometheus.DefaultRegisterer lazily.
+func GetMetricsSet() *rkmidprom.MetricsSet {
+	return metricsSet
+}
+
+// incCounter register counter if missing and increase it with label values
+func incCounter(name string, labelKeys []string, labelValues ...string) {
+	if metricsSet.GetCounter(name) == nil {
+		// ignore duplicate error caused by concurrent registration
+		_ = metricsSet.RegisterCounter(name, labelKeys...)
+	}
+
+	if counter := metricsSet.GetCounterWithValues(name, labelValues...); counter != nil {
+		counter.Inc()
+	}
+}
+
+// setGauge register gauge if missing and set it with label values
+func setGauge(name string, value float64, labelKeys []string, labelValues ...string) {
+	if metricsSet.GetGauge(name) == nil {
+		_ = metricsSet.RegisterGauge(name, labelKeys...)
+	}
+
+	if gauge := metricsSet.GetGaugeWithValues(name, labelValues...); gauge != nil {
+		gauge.Set(value)
+	}
+}
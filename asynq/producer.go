@@ -0,0 +1,64 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel/propagation"
+	"net/http"
+)
+
+const traceHeaderField = "traceHeader"
+
+// NewTracedTask create asynq.Task whose payload carries trace header injected from context.
+//
+// Payload should be a JSON object, trace context and baggage of ctx are written into traceHeader field,
+// so that TraceMiddleware of consumer continues the trace.
+//
+// Tasks created with asynq.NewTask carry neither trace nor baggage, even if enqueued with context of handler.
+func NewTracedTask(ctx context.Context, typeName string, payload []byte, opts ...asynq.Option) (*asynq.Task, error) {
+	payload, err := InjectTraceHeader(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return asynq.NewTask(typeName, payload, opts...), nil
+}
+
+// InjectTraceHeader write trace header of context into traceHeader field of JSON payload.
+//
+// Propagator in context is used if ctx is derived from TraceMiddleware, otherwise TraceContext and Baggage
+// propagators are used.
+func InjectTraceHeader(ctx context.Context, payload []byte) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return nil, err
+		}
+	}
+
+	header := http.Header{}
+	getPropagatorOrDefault(ctx).Inject(ctx, propagation.HeaderCarrier(header))
+
+	raw, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	fields[traceHeaderField] = raw
+
+	return json.Marshal(fields)
+}
+
+func getPropagatorOrDefault(ctx context.Context) propagation.TextMapPropagator {
+	if res := GetPropagator(ctx); res != nil {
+		return res
+	}
+
+	return newDefaultPropagator()
+}
+
+func newDefaultPropagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{})
+}
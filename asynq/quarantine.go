@@ -0,0 +1,529 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"github.com/rs/xid"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	QuarantineSinkQueue = "queue"
+	QuarantineSinkFile  = "file"
+
+	QuarantineReasonUndecodable = "undecodable"
+	QuarantineReasonPanic       = "panic"
+
+	defaultQuarantineQueue          = "quarantine"
+	defaultQuarantinePanicThreshold = 3
+
+	quarantineTaskType = "rk:asynq:quarantine"
+)
+
+// QuarantineConfig defines when tasks are quarantined and where they are copied to.
+//
+// Tasks whose payload could not be decoded are quarantined at once, tasks which panic
+// are quarantined at attempt panicThreshold, or at final attempt if it comes first.
+// Queue sink keeps tasks as pending tasks of a paused queue, file sink writes one JSON file per task.
+//
+// Example:
+//
+//	asynq:
+//	  quarantine:
+//	    enabled: true
+//	    panicThreshold: 3
+//	    sink: queue
+//	    queue: quarantine
+//	    file:
+//	      dir: /data/asynq-quarantine
+type QuarantineConfig struct {
+	Asynq struct {
+		Quarantine struct {
+			Enabled        bool   `yaml:"enabled" json:"enabled"`
+			PanicThreshold int    `yaml:"panicThreshold" json:"panicThreshold"`
+			Sink           string `yaml:"sink" json:"sink"`
+			Queue          string `yaml:"queue" json:"queue"`
+			File           struct {
+				Dir string `yaml:"dir" json:"dir"`
+			} `yaml:"file" json:"file"`
+		} `yaml:"quarantine" json:"quarantine"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// QuarantinedTask is copy of task with raw payload, error and metadata
+type QuarantinedTask struct {
+	Id            string    `json:"id"`
+	Reason        string    `json:"reason"`
+	TaskId        string    `json:"taskId"`
+	Queue         string    `json:"queue"`
+	Type          string    `json:"type"`
+	Payload       []byte    `json:"payload"`
+	Error         string    `json:"error"`
+	ErrorClass    string    `json:"errorClass"`
+	Stack         string    `json:"stack,omitempty"`
+	Retried       int       `json:"retried"`
+	MaxRetry      int       `json:"maxRetry"`
+	QuarantinedAt time.Time `json:"quarantinedAt"`
+}
+
+// QuarantineSink stores quarantined tasks until they are replayed
+type QuarantineSink interface {
+	Put(ctx context.Context, task *QuarantinedTask) error
+
+	Get(ctx context.Context, id string) (*QuarantinedTask, error)
+
+	List(ctx context.Context) ([]*QuarantinedTask, error)
+
+	Delete(ctx context.Context, id string) error
+}
+
+// NewQuarantine create Quarantine from config, used by both QuarantineMiddleware and operators who replay tasks.
+func NewQuarantine(raw []byte, redisOpt asynq.RedisConnOpt) (*Quarantine, error) {
+	conf := &QuarantineConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	c := conf.Asynq.Quarantine
+
+	q := &Quarantine{
+		enabled:        c.Enabled,
+		panicThreshold: c.PanicThreshold,
+	}
+
+	if q.panicThreshold <= 0 {
+		q.panicThreshold = defaultQuarantinePanicThreshold
+	}
+
+	if !q.enabled {
+		return q, nil
+	}
+
+	q.client = asynq.NewClient(redisOpt)
+
+	switch c.Sink {
+	case QuarantineSinkQueue, "":
+		queue := c.Queue
+		if len(queue) < 1 {
+			queue = defaultQuarantineQueue
+		}
+
+		sink, err := NewQueueQuarantineSink(queue, redisOpt)
+		if err != nil {
+			q.client.Close()
+			return nil, err
+		}
+		q.sink = sink
+	case QuarantineSinkFile:
+		sink, err := NewFileQuarantineSink(c.File.Dir)
+		if err != nil {
+			q.client.Close()
+			return nil, err
+		}
+		q.sink = sink
+	default:
+		q.client.Close()
+		return nil, fmt.Errorf("unsupported quarantine sink %s", c.Sink)
+	}
+
+	return q, nil
+}
+
+// Quarantine copies poison tasks into sink and replays them
+type Quarantine struct {
+	enabled        bool
+	panicThreshold int
+	sink           QuarantineSink
+	client         *asynq.Client
+}
+
+// List returns quarantined tasks ordered by quarantine time
+func (q *Quarantine) List(ctx context.Context) ([]*QuarantinedTask, error) {
+	if !q.enabled {
+		return nil, errors.New("quarantine is disabled")
+	}
+
+	res, err := q.sink.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].QuarantinedAt.Before(res[j].QuarantinedAt)
+	})
+
+	return res, nil
+}
+
+// Replay enqueue quarantined task with its raw payload into original queue, and remove it from sink.
+//
+// Max retry of original task is kept, opts are applied after them.
+func (q *Quarantine) Replay(ctx context.Context, id string, opts ...asynq.Option) (*asynq.TaskInfo, error) {
+	if !q.enabled {
+		return nil, errors.New("quarantine is disabled")
+	}
+
+	task, err := q.sink.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	queue := task.Queue
+	if len(queue) < 1 {
+		queue = "default"
+	}
+
+	opts = append([]asynq.Option{asynq.Queue(queue), asynq.MaxRetry(task.MaxRetry)}, opts...)
+
+	info, err := q.client.EnqueueContext(ctx, asynq.NewTask(task.Type, task.Payload), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, q.sink.Delete(ctx, id)
+}
+
+// Close client and sink if it holds connections
+func (q *Quarantine) Close() error {
+	if !q.enabled {
+		return nil
+	}
+
+	if closer, ok := q.sink.(interface{ Close() error }); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+
+	return q.client.Close()
+}
+
+// reason returns why task should be quarantined, empty string if it should not
+func (q *Quarantine) reason(ctx context.Context, err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrUndecodable):
+		return QuarantineReasonUndecodable
+	case IsPanic(err):
+		retried, _ := asynq.GetRetryCount(ctx)
+		if retried+1 >= q.panicThreshold || isFinalAttempt(ctx, err) {
+			return QuarantineReasonPanic
+		}
+	}
+
+	return ""
+}
+
+// NewQuarantineMid create middleware which copies undecodable or repeatedly panicking tasks into quarantine.
+//
+// Middleware should be placed first, before CompressionMiddleware and TraceMiddleware,
+// so that raw payload and decode failures are visible. Quarantined task is failed with SkipRetry.
+func NewQuarantineMid(raw []byte, redisOpt asynq.RedisConnOpt) (asynq.MiddlewareFunc, error) {
+	q, err := NewQuarantine(raw, redisOpt)
+	if err != nil {
+		return nil, err
+	}
+
+	mid := &QuarantineMiddleware{
+		quarantine: q,
+	}
+
+	return mid.Middleware, nil
+}
+
+type QuarantineMiddleware struct {
+	quarantine *Quarantine
+}
+
+func (m *QuarantineMiddleware) Middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if !m.quarantine.enabled {
+			return h.ProcessTask(ctx, t)
+		}
+
+		err := m.process(ctx, h, t)
+
+		reason := m.quarantine.reason(ctx, err)
+		if len(reason) < 1 {
+			return err
+		}
+
+		task := &QuarantinedTask{
+			Id:            xid.New().String(),
+			Reason:        reason,
+			Type:          t.Type(),
+			Payload:       t.Payload(),
+			Error:         err.Error(),
+			ErrorClass:    ClassifyError(err),
+			QuarantinedAt: time.Now(),
+		}
+		task.TaskId, _ = asynq.GetTaskID(ctx)
+		task.Queue, _ = asynq.GetQueueName(ctx)
+		task.Retried, _ = asynq.GetRetryCount(ctx)
+		task.MaxRetry, _ = asynq.GetMaxRetry(ctx)
+
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			task.Stack = panicErr.Stack
+		}
+
+		if putErr := m.quarantine.sink.Put(ctx, task); putErr != nil {
+			// keep retrying until task could be quarantined, unless it is not retryable anyway
+			return fmt.Errorf("quarantine failed: %v: %w", putErr, err)
+		}
+
+		incCounter("quarantine_total", []string{"type", "reason"}, t.Type(), reason)
+
+		return &QuarantinedError{Id: task.Id, Err: err}
+	})
+}
+
+// process run handler and convert panic into PanicError in case TraceMiddleware is not used
+func (m *QuarantineMiddleware) process(ctx context.Context, h asynq.Handler, t *asynq.Task) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{
+				Value: v,
+				Stack: string(debug.Stack()),
+			}
+		}
+	}()
+
+	return h.ProcessTask(ctx, t)
+}
+
+// QuarantinedError is returned by QuarantineMiddleware after task is quarantined, it is asynq.SkipRetry
+type QuarantinedError struct {
+	Id  string
+	Err error
+}
+
+// Error returns quarantine ID and original error
+func (e *QuarantinedError) Error() string {
+	return fmt.Sprintf("quarantined as %s: %v", e.Id, e.Err)
+}
+
+// Unwrap returns original error
+func (e *QuarantinedError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true for asynq.SkipRetry, so that quarantined task is archived at once
+func (e *QuarantinedError) Is(target error) bool {
+	return target == asynq.SkipRetry
+}
+
+// ***************** Queue *****************
+
+// NewQueueQuarantineSink create QuarantineSink which keeps tasks as pending tasks of queue,
+// queue is paused so that servers listening on it won't process them.
+func NewQueueQuarantineSink(queue string, redisOpt asynq.RedisConnOpt) (QuarantineSink, error) {
+	s := &queueQuarantineSink{
+		queue:     queue,
+		client:    asynq.NewClient(redisOpt),
+		inspector: asynq.NewInspector(redisOpt),
+	}
+
+	// queue is not known by inspector before the first task, so paused flag is checked directly
+	// while pausing failed, for example the queue is paused by sink created before
+	if err := s.inspector.PauseQueue(queue); err != nil {
+		if paused, pausedErr := isQueuePaused(redisOpt, queue); pausedErr != nil || !paused {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// isQueuePaused returns true if paused flag of queue exists, see asynq.Inspector.PauseQueue
+func isQueuePaused(redisOpt asynq.RedisConnOpt, queue string) (bool, error) {
+	client, err := NewRedisClient(redisOpt)
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	n, err := client.Exists(context.Background(), fmt.Sprintf("asynq:{%s}:paused", queue)).Result()
+	return n > 0, err
+}
+
+type queueQuarantineSink struct {
+	queue     string
+	client    *asynq.Client
+	inspector *asynq.Inspector
+}
+
+func (s *queueQuarantineSink) Put(ctx context.Context, task *QuarantinedTask) error {
+	raw, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.EnqueueContext(ctx, asynq.NewTask(quarantineTaskType, raw),
+		asynq.Queue(s.queue), asynq.TaskID(task.Id), asynq.MaxRetry(0))
+	return err
+}
+
+func (s *queueQuarantineSink) Get(ctx context.Context, id string) (*QuarantinedTask, error) {
+	info, err := s.inspector.GetTaskInfo(s.queue, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeQuarantinedTask(info.Payload)
+}
+
+func (s *queueQuarantineSink) List(ctx context.Context) ([]*QuarantinedTask, error) {
+	res := make([]*QuarantinedTask, 0)
+
+	for page := 1; ; page++ {
+		infos, err := s.inspector.ListPendingTasks(s.queue, asynq.Page(page), asynq.PageSize(100))
+		if err != nil {
+			// queue is unknown until the first task is quarantined
+			if errors.Is(err, asynq.ErrQueueNotFound) {
+				return res, nil
+			}
+			return nil, err
+		}
+
+		for _, info := range infos {
+			if info.Type != quarantineTaskType {
+				continue
+			}
+
+			task, err := decodeQuarantinedTask(info.Payload)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, task)
+		}
+
+		if len(infos) < 100 {
+			return res, nil
+		}
+	}
+}
+
+func (s *queueQuarantineSink) Delete(ctx context.Context, id string) error {
+	return s.inspector.DeleteTask(s.queue, id)
+}
+
+func (s *queueQuarantineSink) Close() error {
+	if err := s.client.Close(); err != nil {
+		return err
+	}
+
+	return s.inspector.Close()
+}
+
+func decodeQuarantinedTask(raw []byte) (*QuarantinedTask, error) {
+	res := &QuarantinedTask{}
+	if err := json.Unmarshal(raw, res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// ***************** File *****************
+
+// NewFileQuarantineSink create QuarantineSink which writes one JSON file per task into directory.
+func NewFileQuarantineSink(dir string) (QuarantineSink, error) {
+	if len(dir) < 1 {
+		return nil, errors.New("directory of file quarantine sink is required")
+	}
+
+	if !filepath.IsAbs(dir) {
+		wd, _ := os.Getwd()
+		dir = filepath.Join(wd, dir)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &fileQuarantineSink{dir: dir}, nil
+}
+
+type fileQuarantineSink struct {
+	dir string
+}
+
+func (s *fileQuarantineSink) path(id string) (string, error) {
+	// ID is passed by operator, avoid path traversal
+	if !blobRefRegex.MatchString(id) {
+		return "", fmt.Errorf("invalid quarantine ID %s", id)
+	}
+
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+func (s *fileQuarantineSink) Put(ctx context.Context, task *QuarantinedTask) error {
+	path, err := s.path(task.Id)
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.MarshalIndent(task, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, raw, 0600)
+}
+
+func (s *fileQuarantineSink) Get(ctx context.Context, id string) (*QuarantinedTask, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeQuarantinedTask(raw)
+}
+
+func (s *fileQuarantineSink) List(ctx context.Context) ([]*QuarantinedTask, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*QuarantinedTask, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		task, err := s.Get(ctx, strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, task)
+	}
+
+	return res, nil
+}
+
+func (s *fileQuarantineSink) Delete(ctx context.Context, id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,196 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueueQuarantineSink_AlreadyPaused(t *testing.T) {
+	mr, opt, _ := newTestRedis(t)
+	ctx := context.Background()
+
+	// queue has no task and is paused by the first sink
+	first, err := NewQueueQuarantineSink("quarantine", opt)
+	assert.Nil(t, err)
+	assert.True(t, mr.Exists("asynq:{quarantine}:paused"))
+
+	second, err := NewQueueQuarantineSink("quarantine", opt)
+	assert.Nil(t, err)
+
+	assert.Nil(t, first.Put(ctx, &QuarantinedTask{Id: "q1", Type: "order:create", Payload: []byte("{")}))
+
+	// queue is known and paused
+	third, err := NewQueueQuarantineSink("quarantine", opt)
+	assert.Nil(t, err)
+
+	tasks, err := third.List(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, tasks, 1)
+	assert.Equal(t, "q1", tasks[0].Id)
+
+	for _, s := range []QuarantineSink{first, second, third} {
+		assert.Nil(t, s.(*queueQuarantineSink).Close())
+	}
+}
+
+func TestQuarantineMiddleware_Undecodable(t *testing.T) {
+	mr, opt, _ := newTestRedis(t)
+	ctx := context.Background()
+
+	raw := []byte(`
+asynq:
+  quarantine:
+    enabled: true
+    sink: queue
+    queue: quarantine
+`)
+	quarantineMid, err := NewQuarantineMid(raw, opt)
+	assert.Nil(t, err)
+	compressMid, err := NewCompressionMid(nil)
+	assert.Nil(t, err)
+
+	handled := 0
+	h := quarantineMid(compressMid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		handled++
+		return errors.New("failed")
+	})))
+
+	before := counterValue("quarantine_total", "order:create", QuarantineReasonUndecodable)
+
+	// handler errors are returned as they are
+	err = h.ProcessTask(ctx, asynq.NewTask("order:create", []byte(`{}`)))
+	assert.Equal(t, "failed", err.Error())
+	assert.Equal(t, 1, handled)
+
+	// payload which could not be decompressed is quarantined with raw payload
+	payload := []byte(`{"rkCompression":"gzip","body":"bm90IGd6aXA="}`)
+	err = h.ProcessTask(ctx, asynq.NewTask("order:create", payload))
+	assert.True(t, errors.Is(err, asynq.SkipRetry))
+	assert.True(t, errors.Is(err, ErrUndecodable))
+	assert.Equal(t, 1, handled)
+
+	var quarantined *QuarantinedError
+	assert.True(t, errors.As(err, &quarantined))
+	assert.Equal(t, before+1, counterValue("quarantine_total", "order:create", QuarantineReasonUndecodable))
+
+	// task is written into paused queue
+	assert.True(t, mr.Exists("asynq:{quarantine}:paused"))
+
+	q, err := NewQuarantine(raw, opt)
+	assert.Nil(t, err)
+	defer q.Close()
+
+	tasks, err := q.List(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, tasks, 1)
+	assert.Equal(t, quarantined.Id, tasks[0].Id)
+	assert.Equal(t, QuarantineReasonUndecodable, tasks[0].Reason)
+	assert.Equal(t, ErrorClassUndecodable, tasks[0].ErrorClass)
+	assert.Equal(t, payload, tasks[0].Payload)
+
+	// replay enqueues raw payload into original queue and removes it from quarantine
+	info, err := q.Replay(ctx, quarantined.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "default", info.Queue)
+	assert.Equal(t, payload, info.Payload)
+
+	tasks, err = q.List(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, tasks)
+}
+
+func TestQuarantineMiddleware_PanicThreshold(t *testing.T) {
+	_, opt, _ := newTestRedis(t)
+	dir := t.TempDir()
+
+	mid, err := NewQuarantineMid([]byte(`
+asynq:
+  quarantine:
+    enabled: true
+    panicThreshold: 3
+    sink: file
+    file:
+      dir: `+dir+`
+`), opt)
+	assert.Nil(t, err)
+
+	var attempts int32
+	mux := asynq.NewServeMux()
+	mux.Use(mid)
+	mux.HandleFunc("order:create", func(ctx context.Context, t *asynq.Task) error {
+		atomic.AddInt32(&attempts, 1)
+		panic("poison")
+	})
+
+	srv := asynq.NewServer(opt, asynq.Config{
+		Concurrency:              1,
+		LogLevel:                 asynq.FatalLevel,
+		DelayedTaskCheckInterval: 50 * time.Millisecond,
+		RetryDelayFunc: func(n int, e error, t *asynq.Task) time.Duration {
+			return 0
+		},
+	})
+	assert.Nil(t, srv.Start(mux))
+	defer srv.Shutdown()
+
+	client := asynq.NewClient(opt)
+	defer client.Close()
+	info, err := client.Enqueue(asynq.NewTask("order:create", []byte(`{}`)), asynq.MaxRetry(10))
+	assert.Nil(t, err)
+
+	sink, err := NewFileQuarantineSink(dir)
+	assert.Nil(t, err)
+
+	var tasks []*QuarantinedTask
+	assert.Eventually(t, func() bool {
+		tasks, err = sink.List(context.Background())
+		return err == nil && len(tasks) > 0
+	}, 10*time.Second, 20*time.Millisecond)
+
+	// quarantined at the third attempt and archived at once
+	assert.Len(t, tasks, 1)
+	assert.Equal(t, QuarantineReasonPanic, tasks[0].Reason)
+	assert.Equal(t, info.ID, tasks[0].TaskId)
+	assert.Equal(t, 2, tasks[0].Retried)
+	assert.Equal(t, 10, tasks[0].MaxRetry)
+	assert.NotEmpty(t, tasks[0].Stack)
+
+	inspector := asynq.NewInspector(opt)
+	defer inspector.Close()
+	assert.Eventually(t, func() bool {
+		res, err := inspector.GetTaskInfo(info.Queue, info.ID)
+		return err == nil && res.State == asynq.TaskStateArchived
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
+func TestFileQuarantineSink(t *testing.T) {
+	ctx := context.Background()
+
+	sink, err := NewFileQuarantineSink(t.TempDir())
+	assert.Nil(t, err)
+
+	assert.Nil(t, sink.Put(ctx, &QuarantinedTask{Id: "q1", Type: "order:create", Payload: []byte("{")}))
+
+	task, err := sink.Get(ctx, "q1")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("{"), task.Payload)
+
+	tasks, err := sink.List(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, tasks, 1)
+
+	// IDs are not allowed to escape directory
+	_, err = sink.Get(ctx, "../q1")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, sink.Delete(ctx, "q1"))
+	tasks, err = sink.List(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, tasks)
+}
@@ -0,0 +1,181 @@
+package rkasynq
+
+import (
+	"context"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"gopkg.in/yaml.v3"
+	"sync"
+	"time"
+)
+
+const defaultQueueStatsInterval = 15 * time.Second
+
+// QueueStatsConfig defines how queues are polled.
+//
+// Every queue known by redis is polled if queues is empty.
+//
+// Example:
+//
+//	asynq:
+//	  queueStats:
+//	    enabled: true
+//	    interval: 15s
+//	    queues: [default, critical]
+type QueueStatsConfig struct {
+	Asynq struct {
+		QueueStats struct {
+			Enabled  bool     `yaml:"enabled" json:"enabled"`
+			Interval string   `yaml:"interval" json:"interval"`
+			Queues   []string `yaml:"queues" json:"queues"`
+		} `yaml:"queueStats" json:"queueStats"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// NewQueueStatsCollector create collector which polls asynq.Inspector and exports gauges with queue label.
+//
+// Call Bootstrap to start polling in background and Interrupt to stop. Failed polls are counted in
+// queue_stats_scrape_error_total with queue label, which is empty if listing queues failed.
+func NewQueueStatsCollector(raw []byte, redisOpt asynq.RedisConnOpt) (*QueueStatsCollector, error) {
+	conf := &QueueStatsConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	c := &QueueStatsCollector{
+		enabled:  conf.Asynq.QueueStats.Enabled,
+		interval: defaultQueueStatsInterval,
+		queues:   conf.Asynq.QueueStats.Queues,
+	}
+
+	if len(conf.Asynq.QueueStats.Interval) > 0 {
+		d, err := time.ParseDuration(conf.Asynq.QueueStats.Interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid queue stats interval: %s", conf.Asynq.QueueStats.Interval)
+		}
+		c.interval = d
+	}
+
+	if c.enabled {
+		if redisOpt == nil {
+			return nil, fmt.Errorf("redis connection option is nil")
+		}
+		c.redisOpt = redisOpt
+		c.inspector = asynq.NewInspector(redisOpt)
+	}
+
+	return c, nil
+}
+
+// QueueStatsCollector polls queue statistics periodically
+type QueueStatsCollector struct {
+	enabled   bool
+	interval  time.Duration
+	queues    []string
+	redisOpt  asynq.RedisConnOpt
+	inspector *asynq.Inspector
+	lock      sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// Bootstrap collect once and start polling in background
+func (c *QueueStatsCollector) Bootstrap(ctx context.Context) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.enabled || c.stop != nil {
+		return
+	}
+
+	// inspector is closed by previous Interrupt
+	if c.inspector == nil {
+		c.inspector = asynq.NewInspector(c.redisOpt)
+	}
+
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	c.collect(c.inspector)
+
+	go func(inspector *asynq.Inspector, stop, done chan struct{}) {
+		defer close(done)
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.collect(inspector)
+			}
+		}
+	}(c.inspector, c.stop, c.done)
+}
+
+// Interrupt stop polling, wait for ongoing poll and close inspector
+func (c *QueueStatsCollector) Interrupt(ctx context.Context) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+		c.stop, c.done = nil, nil
+
+		c.inspector.Close()
+		c.inspector = nil
+	}
+}
+
+// Collect poll every queue once and update gauges
+func (c *QueueStatsCollector) Collect() {
+	c.lock.Lock()
+	inspector := c.inspector
+	c.lock.Unlock()
+
+	if inspector != nil {
+		c.collect(inspector)
+	}
+}
+
+func (c *QueueStatsCollector) collect(inspector *asynq.Inspector) {
+	queues := c.queues
+	if len(queues) < 1 {
+		var err error
+		if queues, err = inspector.Queues(); err != nil {
+			incCounter("queue_stats_scrape_error_total", []string{"queue"}, "")
+			return
+		}
+	}
+
+	for _, q := range queues {
+		info, err := inspector.GetQueueInfo(q)
+		if err != nil {
+			incCounter("queue_stats_scrape_error_total", []string{"queue"}, q)
+			continue
+		}
+
+		recordQueueInfo(info)
+	}
+}
+
+func recordQueueInfo(info *asynq.QueueInfo) {
+	labels := []string{"queue"}
+
+	paused := 0.0
+	if info.Paused {
+		paused = 1
+	}
+
+	setGauge("queue_pending", float64(info.Pending), labels, info.Queue)
+	setGauge("queue_active", float64(info.Active), labels, info.Queue)
+	setGauge("queue_scheduled", float64(info.Scheduled), labels, info.Queue)
+	setGauge("queue_retry", float64(info.Retry), labels, info.Queue)
+	setGauge("queue_archived", float64(info.Archived), labels, info.Queue)
+	setGauge("queue_completed", float64(info.Completed), labels, info.Queue)
+	setGauge("queue_latency_seconds", info.Latency.Seconds(), labels, info.Queue)
+	setGauge("queue_memory_usage_bytes", float64(info.MemoryUsage), labels, info.Queue)
+	setGauge("queue_paused", paused, labels, info.Queue)
+}
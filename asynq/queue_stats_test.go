@@ -0,0 +1,61 @@
+package rkasynq
+
+import (
+	"context"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestQueueStatsCollector(t *testing.T) {
+	_, opt, _ := newTestRedis(t)
+
+	client := asynq.NewClient(opt)
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Enqueue(asynq.NewTask("stats:test", nil), asynq.Queue("stats-pending"))
+		assert.Nil(t, err)
+	}
+	_, err := client.Enqueue(asynq.NewTask("stats:test", nil), asynq.Queue("stats-paused"), asynq.ProcessIn(time.Hour))
+	assert.Nil(t, err)
+
+	inspector := asynq.NewInspector(opt)
+	defer inspector.Close()
+	assert.Nil(t, inspector.PauseQueue("stats-paused"))
+
+	c, err := NewQueueStatsCollector([]byte(`
+asynq:
+  queueStats:
+    enabled: true
+    interval: 1h
+    queues: [stats-pending, stats-paused, stats-missing]
+`), opt)
+	assert.Nil(t, err)
+
+	scrapeErrors := counterValue("queue_stats_scrape_error_total", "stats-missing")
+
+	ctx := context.Background()
+	c.Bootstrap(ctx)
+
+	assert.Equal(t, 3.0, gaugeValue("queue_pending", "stats-pending"))
+	assert.Equal(t, 0.0, gaugeValue("queue_paused", "stats-pending"))
+	assert.Greater(t, gaugeValue("queue_memory_usage_bytes", "stats-pending"), 0.0)
+	assert.Equal(t, 1.0, gaugeValue("queue_scheduled", "stats-paused"))
+	assert.Equal(t, 1.0, gaugeValue("queue_paused", "stats-paused"))
+	assert.Equal(t, scrapeErrors+1, counterValue("queue_stats_scrape_error_total", "stats-missing"))
+
+	// polling restarts with a new inspector after interrupted
+	c.Interrupt(ctx)
+	c.Collect()
+	assert.Equal(t, scrapeErrors+1, counterValue("queue_stats_scrape_error_total", "stats-missing"))
+
+	_, err = client.Enqueue(asynq.NewTask("stats:test", nil), asynq.Queue("stats-pending"))
+	assert.Nil(t, err)
+
+	c.Bootstrap(ctx)
+	assert.Equal(t, 4.0, gaugeValue("queue_pending", "stats-pending"))
+	assert.Equal(t, scrapeErrors+2, counterValue("queue_stats_scrape_error_total", "stats-missing"))
+	c.Interrupt(ctx)
+}
@@ -0,0 +1,230 @@
+package rkasynq
+
+import (
+	"context"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitBackendLocal = "local"
+	RateLimitBackendRedis = "redis"
+
+	defaultRateLimitKeyPrefix = "rk:asynq:ratelimit:"
+)
+
+// RateLimitConfig defines token bucket per task type.
+//
+// Example:
+//
+//	asynq:
+//	  rateLimit:
+//	    enabled: true
+//	    backend: redis
+//	    tasks:
+//	      email:send:
+//	        rps: 10
+//	        burst: 20
+type RateLimitConfig struct {
+	Asynq struct {
+		RateLimit struct {
+			Enabled   bool   `yaml:"enabled" json:"enabled"`
+			Backend   string `yaml:"backend" json:"backend"`
+			KeyPrefix string `yaml:"keyPrefix" json:"keyPrefix"`
+			Tasks     map[string]struct {
+				Rps   float64 `yaml:"rps" json:"rps"`
+				Burst int     `yaml:"burst" json:"burst"`
+			} `yaml:"tasks" json:"tasks"`
+		} `yaml:"rateLimit" json:"rateLimit"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// RateLimiter take a token from bucket of task type, returns zero if token is available,
+// otherwise returns duration to wait.
+type RateLimiter interface {
+	Take(ctx context.Context, taskType string, rps float64, burst int) (time.Duration, error)
+}
+
+// NewRateLimitMid create middleware which throttles tasks per task type.
+//
+// redisOpt is required while backend is redis, pass the same option used by asynq.Server.
+// Throttled task is rescheduled with RescheduleError, use RetryDelayFunc and IsFailure in asynq.Config.
+func NewRateLimitMid(raw []byte, redisOpt asynq.RedisConnOpt) (asynq.MiddlewareFunc, error) {
+	conf := &RateLimitConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	mid := &RateLimitMiddleware{
+		enabled: conf.Asynq.RateLimit.Enabled,
+		backend: conf.Asynq.RateLimit.Backend,
+		buckets: map[string]rateBucket{},
+	}
+
+	if len(mid.backend) < 1 {
+		mid.backend = RateLimitBackendLocal
+	}
+
+	for k, v := range conf.Asynq.RateLimit.Tasks {
+		if v.Rps <= 0 {
+			return nil, fmt.Errorf("invalid rps of task %s", k)
+		}
+		if v.Burst < 1 {
+			v.Burst = 1
+		}
+		mid.buckets[k] = rateBucket{rps: v.Rps, burst: v.Burst}
+	}
+
+	if !mid.enabled {
+		return mid.Middleware, nil
+	}
+
+	switch mid.backend {
+	case RateLimitBackendLocal:
+		mid.limiter = NewLocalRateLimiter()
+	case RateLimitBackendRedis:
+		client, err := NewRedisClient(redisOpt)
+		if err != nil {
+			return nil, err
+		}
+		mid.limiter = NewRedisRateLimiter(client, conf.Asynq.RateLimit.KeyPrefix)
+	default:
+		return nil, fmt.Errorf("unsupported rate limit backend %s", mid.backend)
+	}
+
+	return mid.Middleware, nil
+}
+
+type rateBucket struct {
+	rps   float64
+	burst int
+}
+
+type RateLimitMiddleware struct {
+	enabled bool
+	backend string
+	buckets map[string]rateBucket
+	limiter RateLimiter
+}
+
+func (m *RateLimitMiddleware) Middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		bucket, ok := m.buckets[t.Type()]
+		if !m.enabled || !ok {
+			return h.ProcessTask(ctx, t)
+		}
+
+		delay, err := m.limiter.Take(ctx, t.Type(), bucket.rps, bucket.burst)
+		if err != nil {
+			// fail open, limiter backend should not block tasks
+			GetSpan(ctx).RecordError(err)
+			return h.ProcessTask(ctx, t)
+		}
+
+		if delay > 0 {
+			GetSpan(ctx).AddEvent("throttled", oteltrace.WithAttributes(
+				attribute.String("asynq.task.type", t.Type()),
+				attribute.String("asynq.ratelimit.backend", m.backend),
+				attribute.String("asynq.ratelimit.delay", delay.String()),
+			))
+
+			return Reschedule(fmt.Sprintf("rate limit of %s exceeded", t.Type()), delay)
+		}
+
+		return h.ProcessTask(ctx, t)
+	})
+}
+
+// ***************** Local *****************
+
+// NewLocalRateLimiter create in-process RateLimiter
+func NewLocalRateLimiter() RateLimiter {
+	return &localRateLimiter{
+		limiters: map[string]*rate.Limiter{},
+	}
+}
+
+type localRateLimiter struct {
+	lock     sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func (l *localRateLimiter) Take(ctx context.Context, taskType string, rps float64, burst int) (time.Duration, error) {
+	l.lock.Lock()
+	limiter, ok := l.limiters[taskType]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(rps), burst)
+		l.limiters[taskType] = limiter
+	}
+	l.lock.Unlock()
+
+	r := limiter.Reserve()
+	if delay := r.Delay(); delay > 0 {
+		// don't consume token while rescheduled
+		r.Cancel()
+		return delay, nil
+	}
+
+	return 0, nil
+}
+
+// ***************** Redis *****************
+
+// token bucket stored in hash, time is taken from redis so that workers share the same clock
+var redisTokenBucketScript = redis.NewScript(`
+local rps = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local data = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(data[1]) or burst
+local ts = tonumber(data[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rps / 1000)
+
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rps)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rps) + 1000)
+
+return wait
+`)
+
+// NewRedisRateLimiter create RateLimiter shared by all workers connected to the same redis.
+func NewRedisRateLimiter(client redis.UniversalClient, keyPrefix string) RateLimiter {
+	if len(keyPrefix) < 1 {
+		keyPrefix = defaultRateLimitKeyPrefix
+	}
+
+	return &redisRateLimiter{
+		client:    client,
+		keyPrefix: keyPrefix,
+	}
+}
+
+type redisRateLimiter struct {
+	client    redis.UniversalClient
+	keyPrefix string
+}
+
+func (l *redisRateLimiter) Take(ctx context.Context, taskType string, rps float64, burst int) (time.Duration, error) {
+	wait, err := redisTokenBucketScript.Run(ctx, l.client, []string{l.keyPrefix + taskType}, rps, burst).Int64()
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,76 @@
+package rkasynq
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLocalRateLimiter_Take(t *testing.T) {
+	limiter := NewLocalRateLimiter()
+	ctx := context.Background()
+
+	delay, err := limiter.Take(ctx, "a", 1, 1)
+	assert.Nil(t, err)
+	assert.Zero(t, delay)
+
+	first, err := limiter.Take(ctx, "a", 1, 1)
+	assert.Nil(t, err)
+	assert.True(t, first > 0 && first <= time.Second)
+
+	// rejected reservation is cancelled, so that token is not consumed by throttled task
+	second, err := limiter.Take(ctx, "a", 1, 1)
+	assert.Nil(t, err)
+	assert.True(t, second > 0 && second <= first)
+
+	// bucket is per task type
+	delay, err = limiter.Take(ctx, "b", 1, 1)
+	assert.Nil(t, err)
+	assert.Zero(t, delay)
+}
+
+func TestRedisRateLimiter_Take(t *testing.T) {
+	_, _, client := newTestRedis(t)
+	limiter := NewRedisRateLimiter(client, "")
+	ctx := context.Background()
+
+	// burst
+	for i := 0; i < 2; i++ {
+		delay, err := limiter.Take(ctx, "a", 1, 2)
+		assert.Nil(t, err)
+		assert.Zero(t, delay)
+	}
+
+	delay, err := limiter.Take(ctx, "a", 1, 2)
+	assert.Nil(t, err)
+	assert.True(t, delay > 0 && delay <= time.Second)
+
+	delay, err = limiter.Take(ctx, "b", 1, 2)
+	assert.Nil(t, err)
+	assert.Zero(t, delay)
+
+	ttl := client.PTTL(ctx, defaultRateLimitKeyPrefix+"a").Val()
+	assert.True(t, ttl > 0)
+}
+
+func TestRedisRateLimiter_Refill(t *testing.T) {
+	_, _, client := newTestRedis(t)
+	limiter := NewRedisRateLimiter(client, "test:")
+	ctx := context.Background()
+
+	delay, err := limiter.Take(ctx, "a", 20, 1)
+	assert.Nil(t, err)
+	assert.Zero(t, delay)
+
+	delay, err = limiter.Take(ctx, "a", 20, 1)
+	assert.Nil(t, err)
+	assert.True(t, delay > 0)
+
+	// one token per 50ms
+	time.Sleep(100 * time.Millisecond)
+
+	delay, err = limiter.Take(ctx, "a", 20, 1)
+	assert.Nil(t, err)
+	assert.Zero(t, delay)
+}
@@ -0,0 +1,22 @@
+package rkasynq
+
+import (
+	"errors"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+)
+
+// NewRedisClient create redis client from asynq.RedisConnOpt,
+// so that middlewares could share the same redis with asynq server.
+func NewRedisClient(opt asynq.RedisConnOpt) (redis.UniversalClient, error) {
+	if opt == nil {
+		return nil, errors.New("redis connection option is nil")
+	}
+
+	client, ok := opt.MakeRedisClient().(redis.UniversalClient)
+	if !ok {
+		return nil, errors.New("unsupported redis connection option")
+	}
+
+	return client, nil
+}
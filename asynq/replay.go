@@ -0,0 +1,278 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	archivedPageSize = 100
+
+	// replayTaskIdPrefix prefixes ID of replayed task, so that archived task is replayed at most once
+	replayTaskIdPrefix = "replay-"
+)
+
+// ArchivedFilter selects archived tasks, empty fields match every task
+type ArchivedFilter struct {
+	// Queue of tasks, every queue if empty
+	Queue string
+	// Type of tasks
+	Type string
+	// ErrorContains is substring of last error
+	ErrorContains string
+	// Since and Until is window of last failure
+	Since time.Time
+	Until time.Time
+	// Limit of tasks, no limit if not positive
+	Limit int
+}
+
+func (f *ArchivedFilter) match(info *asynq.TaskInfo) bool {
+	switch {
+	case len(f.Type) > 0 && info.Type != f.Type:
+		return false
+	case len(f.ErrorContains) > 0 && !strings.Contains(info.LastErr, f.ErrorContains):
+		return false
+	case !f.Since.IsZero() && info.LastFailedAt.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && info.LastFailedAt.After(f.Until):
+		return false
+	}
+
+	return true
+}
+
+// ReplayerOption is option of NewReplayer
+type ReplayerOption func(*Replayer)
+
+// WithReplayBlobStore set BlobStore of ClaimCheck, which is required to replay claim-checked tasks.
+//
+// Blobs of archived tasks are kept only if keepArchived of ClaimCheckConfig is enabled.
+func WithReplayBlobStore(store BlobStore) ReplayerOption {
+	return func(r *Replayer) {
+		r.store = store
+	}
+}
+
+// NewReplayer create Replayer which re-enqueues archived tasks.
+//
+// Tracer and propagator are taken from shared trace with traceName, see GetSharedTrace.
+func NewReplayer(redisOpt asynq.RedisConnOpt, traceName string, opts ...ReplayerOption) (*Replayer, error) {
+	shared, err := GetSharedTrace(traceName)
+	if err != nil {
+		return nil, err
+	}
+
+	propagator := shared.Propagator
+	if propagator == nil {
+		propagator = newDefaultPropagator()
+	}
+
+	r := &Replayer{
+		client:     asynq.NewClient(redisOpt),
+		inspector:  asynq.NewInspector(redisOpt),
+		tracer:     shared.Provider.Tracer("rk-asynq-replay"),
+		propagator: propagator,
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r, nil
+}
+
+// Replayer list and re-enqueue archived tasks
+type Replayer struct {
+	client     *asynq.Client
+	inspector  *asynq.Inspector
+	tracer     oteltrace.Tracer
+	propagator propagation.TextMapPropagator
+	store      BlobStore
+}
+
+// List returns archived tasks matching filter
+func (r *Replayer) List(filter *ArchivedFilter) ([]*asynq.TaskInfo, error) {
+	queues := []string{filter.Queue}
+	if len(filter.Queue) < 1 {
+		var err error
+		if queues, err = r.inspector.Queues(); err != nil {
+			return nil, err
+		}
+	}
+
+	res := make([]*asynq.TaskInfo, 0)
+	for _, queue := range queues {
+		for page := 1; ; page++ {
+			infos, err := r.inspector.ListArchivedTasks(queue, asynq.Page(page), asynq.PageSize(archivedPageSize))
+			if err != nil {
+				return nil, err
+			}
+
+			for _, info := range infos {
+				if !filter.match(info) {
+					continue
+				}
+
+				res = append(res, info)
+				if filter.Limit > 0 && len(res) >= filter.Limit {
+					return res, nil
+				}
+			}
+
+			if len(infos) < archivedPageSize {
+				break
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// Replay enqueue archived task as a new task into the same queue with the same max retry, timeout, deadline,
+// retention and group, and delete archived one.
+//
+// Archived task is kept if replay could not succeed, for example blob of claim-checked task is missing,
+// or no BlobStore is set to verify it.
+// Replayed task has ID of archived one prefixed with "replay-", if archived task could not be deleted
+// after replayed task is enqueued, calling Replay again only deletes it, unless replayed task has been
+// processed and removed already, which is enqueued again.
+//
+// If newTrace is false, traceHeader is kept and consumer span joins the original trace.
+// Otherwise, a new trace is started with link to the original one, traceHeader is replaced
+// and original header is kept in traceLinks. Signed tasks are refused since new trace header
+// invalidates signature.
+func (r *Replayer) Replay(ctx context.Context, info *asynq.TaskInfo, newTrace bool) (*asynq.TaskInfo, error) {
+	payload := info.Payload
+
+	if err := r.checkBlob(ctx, info); err != nil {
+		return nil, err
+	}
+
+	if newTrace {
+		var p signedPayload
+		if json.Unmarshal(payload, &p) == nil && len(p.Signature.Name) > 0 {
+			return nil, fmt.Errorf("task %s is signed, new trace would invalidate signature", info.ID)
+		}
+
+		header := readTraceHeader(payload)
+
+		links := make([]oteltrace.Link, 0)
+		spanCtx := oteltrace.SpanContextFromContext(
+			r.propagator.Extract(context.Background(), propagation.HeaderCarrier(header)))
+		if spanCtx.IsValid() {
+			links = append(links, oteltrace.Link{SpanContext: spanCtx})
+		}
+
+		var span oteltrace.Span
+		ctx, span = r.tracer.Start(ctx, fmt.Sprintf("replay %s", info.Type),
+			oteltrace.WithNewRoot(),
+			oteltrace.WithSpanKind(oteltrace.SpanKindProducer),
+			oteltrace.WithLinks(links...),
+			oteltrace.WithAttributes(
+				attribute.String("asynq.task.id", info.ID),
+				attribute.String("asynq.task.type", info.Type),
+				attribute.String("asynq.queue", info.Queue),
+			))
+		defer span.End()
+
+		ctx = context.WithValue(ctx, propagatorKey, r.propagator)
+
+		headers := make([]http.Header, 0)
+		if spanCtx.IsValid() {
+			headers = append(headers, header)
+		}
+
+		var err error
+		if payload, err = injectTraceLinks(ctx, payload, headers); err != nil {
+			span.RecordError(err)
+			return nil, fmt.Errorf("start new trace of task %s failed: %v", info.ID, err)
+		}
+	}
+
+	id := replayTaskIdPrefix + info.ID
+	res, err := r.client.EnqueueContext(ctx, asynq.NewTask(info.Type, payload), replayOptions(info, id)...)
+	if errors.Is(err, asynq.ErrTaskIDConflict) {
+		// replayed before while archived task was not deleted
+		res, err = r.inspector.GetTaskInfo(info.Queue, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.inspector.DeleteTask(info.Queue, info.ID); err != nil {
+		return res, fmt.Errorf("task %s is replayed as %s, but delete archived task failed: %w", info.ID, res.ID, err)
+	}
+
+	return res, nil
+}
+
+// replayOptions returns options of archived task
+func replayOptions(info *asynq.TaskInfo, id string) []asynq.Option {
+	res := []asynq.Option{asynq.TaskID(id), asynq.Queue(info.Queue), asynq.MaxRetry(info.MaxRetry)}
+
+	if info.Timeout > 0 {
+		res = append(res, asynq.Timeout(info.Timeout))
+	}
+
+	if !info.Deadline.IsZero() {
+		res = append(res, asynq.Deadline(info.Deadline))
+	}
+
+	if info.Retention > 0 {
+		res = append(res, asynq.Retention(info.Retention))
+	}
+
+	if len(info.Group) > 0 {
+		res = append(res, asynq.Group(info.Group))
+	}
+
+	return res
+}
+
+// checkBlob returns error if task is claim-checked and its blob could not be fetched
+func (r *Replayer) checkBlob(ctx context.Context, info *asynq.TaskInfo) error {
+	var p claimCheckPayload
+	if json.Unmarshal(info.Payload, &p) != nil || len(p.ClaimCheck.Ref) < 1 {
+		return nil
+	}
+
+	if r.store == nil {
+		return fmt.Errorf("task %s is claim-checked as %s, blob store is required to replay it", info.ID, p.ClaimCheck.Ref)
+	}
+
+	if _, err := r.store.Get(ctx, p.ClaimCheck.Ref); err != nil {
+		return fmt.Errorf("fetch blob %s of task %s failed: %w", p.ClaimCheck.Ref, info.ID, err)
+	}
+
+	return nil
+}
+
+// TraceIdOf returns trace ID in traceHeader of payload, empty string if missing
+func (r *Replayer) TraceIdOf(payload []byte) string {
+	spanCtx := oteltrace.SpanContextFromContext(
+		r.propagator.Extract(context.Background(), propagation.HeaderCarrier(readTraceHeader(payload))))
+	if !spanCtx.HasTraceID() {
+		return ""
+	}
+
+	return spanCtx.TraceID().String()
+}
+
+// Close client and inspector
+func (r *Replayer) Close() error {
+	if err := r.client.Close(); err != nil {
+		return err
+	}
+
+	return r.inspector.Close()
+}
@@ -0,0 +1,195 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"testing"
+	"time"
+)
+
+func TestReplayer_ClaimCheckedTask(t *testing.T) {
+	_, opt, _ := newTestRedis(t)
+	ctx := context.Background()
+
+	RegisterSharedTrace("replay-test", sdktrace.NewTracerProvider(), nil)
+
+	store, err := NewFileBlobStore(t.TempDir())
+	assert.Nil(t, err)
+
+	claimCheck, err := NewClaimCheck([]byte(`
+asynq:
+  claimCheck:
+    enabled: true
+    threshold: 1
+`), store)
+	assert.Nil(t, err)
+
+	client := asynq.NewClient(opt)
+	defer client.Close()
+	inspector := asynq.NewInspector(opt)
+	defer inspector.Close()
+
+	// archive returns archived task with offloaded payload
+	archive := func() *asynq.TaskInfo {
+		task, err := claimCheck.NewTask(ctx, "replay:test", []byte(`{"amount":1}`))
+		assert.Nil(t, err)
+
+		info, err := client.Enqueue(task)
+		assert.Nil(t, err)
+		assert.Nil(t, inspector.ArchiveTask(info.Queue, info.ID))
+
+		info, err = inspector.GetTaskInfo(info.Queue, info.ID)
+		assert.Nil(t, err)
+
+		return info
+	}
+
+	t.Run("WithoutStore", func(t *testing.T) {
+		replayer, err := NewReplayer(opt, "replay-test")
+		assert.Nil(t, err)
+		defer replayer.Close()
+
+		info := archive()
+		_, err = replayer.Replay(ctx, info, false)
+		assert.NotNil(t, err)
+
+		_, err = inspector.GetTaskInfo(info.Queue, info.ID)
+		assert.Nil(t, err)
+	})
+
+	t.Run("BlobMissing", func(t *testing.T) {
+		replayer, err := NewReplayer(opt, "replay-test", WithReplayBlobStore(store))
+		assert.Nil(t, err)
+		defer replayer.Close()
+
+		info := archive()
+		var p claimCheckPayload
+		assert.Nil(t, json.Unmarshal(info.Payload, &p))
+		assert.Nil(t, store.Delete(ctx, p.ClaimCheck.Ref))
+
+		_, err = replayer.Replay(ctx, info, true)
+		assert.True(t, errors.Is(err, ErrBlobNotFound))
+
+		_, err = inspector.GetTaskInfo(info.Queue, info.ID)
+		assert.Nil(t, err)
+	})
+
+	t.Run("Replayed", func(t *testing.T) {
+		replayer, err := NewReplayer(opt, "replay-test", WithReplayBlobStore(store))
+		assert.Nil(t, err)
+		defer replayer.Close()
+
+		info := archive()
+		replayed, err := replayer.Replay(ctx, info, false)
+		assert.Nil(t, err)
+		assert.Equal(t, info.Payload, replayed.Payload)
+
+		_, err = inspector.GetTaskInfo(info.Queue, info.ID)
+		assert.True(t, errors.Is(err, asynq.ErrTaskNotFound))
+	})
+}
+
+func TestReplayer_Replay(t *testing.T) {
+	_, opt, _ := newTestRedis(t)
+	ctx := context.Background()
+
+	RegisterSharedTrace("replay-test", sdktrace.NewTracerProvider(), nil)
+	t.Setenv("TEST_REPLAY_SECRET", "c2VjcmV0")
+
+	client := asynq.NewClient(opt)
+	defer client.Close()
+	inspector := asynq.NewInspector(opt)
+	defer inspector.Close()
+
+	replayer, err := NewReplayer(opt, "replay-test")
+	assert.Nil(t, err)
+	defer replayer.Close()
+
+	// archive returns archived task enqueued with payload and opts
+	archive := func(payload []byte, opts ...asynq.Option) *asynq.TaskInfo {
+		info, err := client.Enqueue(asynq.NewTask("replay:test", payload), opts...)
+		assert.Nil(t, err)
+		assert.Nil(t, inspector.ArchiveTask(info.Queue, info.ID))
+
+		info, err = inspector.GetTaskInfo(info.Queue, info.ID)
+		assert.Nil(t, err)
+
+		return info
+	}
+
+	t.Run("KeepOptions", func(t *testing.T) {
+		deadline := time.Now().Add(time.Hour).Truncate(time.Second)
+		info := archive([]byte(`{}`), asynq.Queue("critical"), asynq.MaxRetry(7), asynq.Timeout(time.Minute),
+			asynq.Deadline(deadline), asynq.Retention(2*time.Hour))
+
+		replayed, err := replayer.Replay(ctx, info, false)
+		assert.Nil(t, err)
+		assert.Equal(t, "replay-"+info.ID, replayed.ID)
+		assert.Equal(t, "critical", replayed.Queue)
+		assert.Equal(t, 7, replayed.MaxRetry)
+		assert.Equal(t, time.Minute, replayed.Timeout)
+		assert.True(t, deadline.Equal(replayed.Deadline))
+		assert.Equal(t, 2*time.Hour, replayed.Retention)
+
+		info = archive([]byte(`{}`), asynq.Group("batch"))
+		replayed, err = replayer.Replay(ctx, info, false)
+		assert.Nil(t, err)
+		assert.Equal(t, "batch", replayed.Group)
+	})
+
+	t.Run("SignedNewTrace", func(t *testing.T) {
+		signer, err := NewSigner([]byte(`
+asynq:
+  signing:
+    enabled: true
+    activeSecret: s1
+    secrets:
+      - name: s1
+        env: TEST_REPLAY_SECRET
+`))
+		assert.Nil(t, err)
+
+		task, err := signer.NewTask(ctx, "replay:test", []byte(`{}`))
+		assert.Nil(t, err)
+		info := archive(task.Payload())
+
+		// signature would be invalidated by new trace header
+		_, err = replayer.Replay(ctx, info, true)
+		assert.NotNil(t, err)
+		_, err = inspector.GetTaskInfo(info.Queue, info.ID)
+		assert.Nil(t, err)
+
+		replayed, err := replayer.Replay(ctx, info, false)
+		assert.Nil(t, err)
+		assert.Equal(t, info.Payload, replayed.Payload)
+	})
+
+	t.Run("DeleteFailedBefore", func(t *testing.T) {
+		info := archive([]byte(`{}`))
+
+		// replayed task was enqueued while archived one was not deleted
+		enqueued, err := client.Enqueue(asynq.NewTask("replay:test", info.Payload), asynq.TaskID("replay-"+info.ID))
+		assert.Nil(t, err)
+
+		replayed, err := replayer.Replay(ctx, info, false)
+		assert.Nil(t, err)
+		assert.Equal(t, enqueued.ID, replayed.ID)
+
+		_, err = inspector.GetTaskInfo(info.Queue, info.ID)
+		assert.True(t, errors.Is(err, asynq.ErrTaskNotFound))
+
+		tasks, err := inspector.ListPendingTasks(info.Queue)
+		assert.Nil(t, err)
+		count := 0
+		for _, v := range tasks {
+			if v.ID == enqueued.ID {
+				count++
+			}
+		}
+		assert.Equal(t, 1, count)
+	})
+}
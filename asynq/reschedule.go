@@ -0,0 +1,52 @@
+package rkasynq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"time"
+)
+
+// RescheduleError is returned by middlewares which decided not to run handler at the moment,
+// for example while task is throttled. Task will be retried after Delay.
+//
+// Use RetryDelayFunc and IsFailure in asynq.Config, so that rescheduled task won't consume retry count.
+type RescheduleError struct {
+	Reason string
+	Delay  time.Duration
+}
+
+// Error returns reason and delay of reschedule
+func (e *RescheduleError) Error() string {
+	return fmt.Sprintf("task rescheduled in %s: %s", e.Delay, e.Reason)
+}
+
+// Reschedule create RescheduleError with reason and delay.
+func Reschedule(reason string, delay time.Duration) error {
+	return &RescheduleError{
+		Reason: reason,
+		Delay:  delay,
+	}
+}
+
+// IsRescheduled returns true if error is, or wraps RescheduleError
+func IsRescheduled(err error) bool {
+	var res *RescheduleError
+	return errors.As(err, &res)
+}
+
+// IsFailure could be used as asynq.Config.IsFailure, rescheduled task is not treated as failure.
+func IsFailure(err error) bool {
+	return err != nil && !IsRescheduled(err)
+}
+
+// RetryDelayFunc could be used as asynq.Config.RetryDelayFunc,
+// it returns delay of RescheduleError and falls back to asynq.DefaultRetryDelayFunc.
+func RetryDelayFunc(n int, err error, t *asynq.Task) time.Duration {
+	var res *RescheduleError
+	if errors.As(err, &res) && res.Delay > 0 {
+		return res.Delay
+	}
+
+	return asynq.DefaultRetryDelayFunc(n, err, t)
+}
@@ -0,0 +1,157 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sort"
+)
+
+const (
+	defaultPodNameEnv      = "POD_NAME"
+	defaultPodNamespaceEnv = "POD_NAMESPACE"
+)
+
+// ResourceConfig describes resource attached to every span exported by middleware.
+//
+// Kubernetes pod and namespace are read from environment variables which are expected
+// to be populated by downward API. Other keys with scalar value are custom attributes,
+// attributes could be used for keys which collide with detectors.
+//
+// Example:
+//
+//	asynq:
+//	  trace:
+//	    resource:
+//	      host: true
+//	      container: true
+//	      kubernetes:
+//	        enabled: true
+//	      deployment.environment: prod
+//	      team: payment
+type ResourceConfig struct {
+	Host       bool `yaml:"host" json:"host"`
+	OS         bool `yaml:"os" json:"os"`
+	Process    bool `yaml:"process" json:"process"`
+	Container  bool `yaml:"container" json:"container"`
+	Kubernetes struct {
+		Enabled      bool   `yaml:"enabled" json:"enabled"`
+		PodNameEnv   string `yaml:"podNameEnv" json:"podNameEnv"`
+		NamespaceEnv string `yaml:"namespaceEnv" json:"namespaceEnv"`
+	} `yaml:"kubernetes" json:"kubernetes"`
+	Attributes map[string]string `yaml:"attributes" json:"attributes"`
+}
+
+// resourceConfigKeys are keys of ResourceConfig fields, which are not custom attributes
+var resourceConfigKeys = map[string]bool{
+	"host":       true,
+	"os":         true,
+	"process":    true,
+	"container":  true,
+	"kubernetes": true,
+	"attributes": true,
+}
+
+// UnmarshalYAML decode fields of ResourceConfig, and other scalar keys into Attributes
+func (c *ResourceConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain ResourceConfig
+	if err := node.Decode((*plain)(c)); err != nil {
+		return err
+	}
+
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		if resourceConfigKeys[k.Value] || v.Kind != yaml.ScalarNode {
+			continue
+		}
+
+		if c.Attributes == nil {
+			c.Attributes = map[string]string{}
+		}
+		c.Attributes[k.Value] = v.Value
+	}
+
+	return nil
+}
+
+// NewResource create sdkresource.Resource with service name, version and detectors enabled in ResourceConfig.
+//
+// Partial detection failure, for example container ID is missing while running outside of container,
+// won't be treated as error.
+func NewResource(serviceName, serviceVersion string, conf *ResourceConfig) (*sdkresource.Resource, error) {
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(serviceVersion),
+	}
+
+	opts := make([]sdkresource.Option, 0)
+
+	if conf != nil {
+		if conf.Host {
+			opts = append(opts, sdkresource.WithHost())
+		}
+		if conf.OS {
+			opts = append(opts, sdkresource.WithOS())
+		}
+		if conf.Process {
+			opts = append(opts, sdkresource.WithProcess())
+		}
+		if conf.Container {
+			opts = append(opts, sdkresource.WithContainer())
+		}
+
+		if conf.Kubernetes.Enabled {
+			attrs = append(attrs, kubernetesAttributes(conf.Kubernetes.PodNameEnv, conf.Kubernetes.NamespaceEnv)...)
+		}
+
+		// sort keys so that resource is stable between restarts
+		keys := make([]string, 0, len(conf.Attributes))
+		for k := range conf.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			attrs = append(attrs, attribute.String(k, conf.Attributes[k]))
+		}
+	}
+
+	opts = append(opts,
+		sdkresource.WithSchemaURL(semconv.SchemaURL),
+		sdkresource.WithAttributes(attrs...))
+
+	res, err := sdkresource.New(context.Background(), opts...)
+	if err != nil && !errors.Is(err, sdkresource.ErrPartialResource) {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func kubernetesAttributes(podNameEnv, namespaceEnv string) []attribute.KeyValue {
+	if len(podNameEnv) < 1 {
+		podNameEnv = defaultPodNameEnv
+	}
+	if len(namespaceEnv) < 1 {
+		namespaceEnv = defaultPodNamespaceEnv
+	}
+
+	res := make([]attribute.KeyValue, 0)
+
+	if v := os.Getenv(podNameEnv); len(v) > 0 {
+		res = append(res, semconv.K8SPodName(v))
+	}
+	if v := os.Getenv(namespaceEnv); len(v) > 0 {
+		res = append(res, semconv.K8SNamespaceName(v))
+	}
+
+	return res
+}
@@ -0,0 +1,96 @@
+package rkasynq
+
+import (
+	"github.com/stretchr/testify/assert"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	"gopkg.in/yaml.v3"
+	"testing"
+)
+
+// resourceValue returns value of attribute in resource, empty if missing
+func resourceValue(res *sdkresource.Resource, key string) string {
+	for _, kv := range res.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value.Emit()
+		}
+	}
+
+	return ""
+}
+
+func newTestResource(t *testing.T, raw string) *sdkresource.Resource {
+	conf := &TraceConfig{}
+	assert.Nil(t, yaml.Unmarshal([]byte(raw), conf))
+
+	res, err := NewResource("worker", "v1", &conf.Asynq.Trace.Resource)
+	assert.Nil(t, err)
+
+	return res
+}
+
+func TestNewResource_Kubernetes(t *testing.T) {
+	t.Setenv("POD_NAME", "worker-0")
+	t.Setenv("POD_NAMESPACE", "jobs")
+	t.Setenv("MY_POD", "worker-1")
+	t.Setenv("MY_NAMESPACE", "batch")
+
+	res := newTestResource(t, `
+asynq:
+  trace:
+    resource:
+      kubernetes:
+        enabled: true
+`)
+	assert.Equal(t, "worker", resourceValue(res, "service.name"))
+	assert.Equal(t, "v1", resourceValue(res, "service.version"))
+	assert.Equal(t, "worker-0", resourceValue(res, "k8s.pod.name"))
+	assert.Equal(t, "jobs", resourceValue(res, "k8s.namespace.name"))
+
+	res = newTestResource(t, `
+asynq:
+  trace:
+    resource:
+      kubernetes:
+        enabled: true
+        podNameEnv: MY_POD
+        namespaceEnv: MY_NAMESPACE
+`)
+	assert.Equal(t, "worker-1", resourceValue(res, "k8s.pod.name"))
+	assert.Equal(t, "batch", resourceValue(res, "k8s.namespace.name"))
+
+	// disabled
+	res = newTestResource(t, `
+asynq:
+  trace:
+    resource:
+      host: false
+`)
+	assert.Empty(t, resourceValue(res, "k8s.pod.name"))
+}
+
+func TestNewResource_CustomAttributes(t *testing.T) {
+	res := newTestResource(t, `
+asynq:
+  trace:
+    resource:
+      host: true
+      kubernetes:
+        enabled: false
+      deployment.environment: prod
+      team: payment
+      attributes:
+        host: shared-host
+`)
+
+	assert.Equal(t, "prod", resourceValue(res, "deployment.environment"))
+	assert.Equal(t, "payment", resourceValue(res, "team"))
+	assert.Equal(t, "shared-host", resourceValue(res, "host"))
+	assert.NotEmpty(t, resourceValue(res, "host.name"))
+	assert.Empty(t, resourceValue(res, "kubernetes"))
+
+	// nil config carries service only
+	res, err := NewResource("worker", "v1", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "worker", resourceValue(res, "service.name"))
+	assert.Empty(t, resourceValue(res, "host.name"))
+}
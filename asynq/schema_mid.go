@@ -0,0 +1,162 @@
+package rkasynq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+)
+
+// SchemaConfig defines JSON Schema file of each task type.
+//
+// Task types without schema are passed as they are.
+// Fields injected by this package, traceHeader, traceLinks and payloadVersion, are removed before validation,
+// so that schemas could disallow additional properties.
+//
+// Example:
+//
+//	asynq:
+//	  schema:
+//	    enabled: true
+//	    tasks:
+//	      email:deliver: schemas/email-deliver.json
+//	      image:resize: schemas/image-resize.json
+type SchemaConfig struct {
+	Asynq struct {
+		Schema struct {
+			Enabled bool              `yaml:"enabled" json:"enabled"`
+			Tasks   map[string]string `yaml:"tasks" json:"tasks"`
+		} `yaml:"schema" json:"schema"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// NewSchemaMid create middleware which validates payload against JSON Schema of task type.
+//
+// Invalid task is failed with SkipRetry, and payload which is not a valid JSON with ErrUndecodable. Middleware should be placed after TraceMiddleware
+// so that validation errors are recorded on span.
+func NewSchemaMid(raw []byte) (asynq.MiddlewareFunc, error) {
+	conf := &SchemaConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	mid := &SchemaMiddleware{
+		enabled: conf.Asynq.Schema.Enabled,
+		schemas: map[string]*jsonschema.Schema{},
+	}
+
+	if !mid.enabled {
+		return mid.Middleware, nil
+	}
+
+	compiler := jsonschema.NewCompiler()
+	for typeName, file := range conf.Asynq.Schema.Tasks {
+		if !filepath.IsAbs(file) {
+			wd, _ := os.Getwd()
+			file = filepath.Join(wd, file)
+		}
+
+		schema, err := compiler.Compile(file)
+		if err != nil {
+			return nil, fmt.Errorf("compile schema of %s failed: %v", typeName, err)
+		}
+		mid.schemas[typeName] = schema
+	}
+
+	return mid.Middleware, nil
+}
+
+type SchemaMiddleware struct {
+	enabled bool
+	schemas map[string]*jsonschema.Schema
+}
+
+func (m *SchemaMiddleware) Middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		schema, ok := m.schemas[t.Type()]
+		if !m.enabled || !ok {
+			return h.ProcessTask(ctx, t)
+		}
+
+		errs, err := validatePayload(schema, t.Payload())
+		if err != nil {
+			err = fmt.Errorf("json.Unmarshal failed: %v: %w", err, ErrUndecodable)
+			span := GetSpan(ctx)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
+		if len(errs) > 0 {
+			span := GetSpan(ctx)
+			span.AddEvent("schema_invalid", oteltrace.WithAttributes(
+				attribute.String("asynq.task.type", t.Type()),
+				attribute.StringSlice("asynq.schema.errors", errs),
+			))
+			incCounter("schema_invalid_total", []string{"type"}, t.Type())
+
+			err := fmt.Errorf("payload does not match schema: %v: %w", errs, asynq.SkipRetry)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
+		return h.ProcessTask(ctx, t)
+	})
+}
+
+// validatePayload returns validation errors formatted as "<instance location>: <message>",
+// error is returned if payload is not a valid JSON.
+func validatePayload(schema *jsonschema.Schema, payload []byte) ([]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	if obj, ok := v.(map[string]interface{}); ok {
+		delete(obj, traceHeaderField)
+		delete(obj, traceLinksField)
+		delete(obj, payloadVersionField)
+	}
+
+	err := schema.Validate(v)
+	if err == nil {
+		return nil, nil
+	}
+
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return []string{err.Error()}, nil
+	}
+
+	res := make([]string, 0)
+	collectSchemaErrors(ve, &res)
+	return res, nil
+}
+
+// collectSchemaErrors collects leaf errors only, parents are summaries of their causes
+func collectSchemaErrors(ve *jsonschema.ValidationError, res *[]string) {
+	if len(ve.Causes) < 1 {
+		loc := ve.InstanceLocation
+		if len(loc) < 1 {
+			loc = "/"
+		}
+		*res = append(*res, fmt.Sprintf("%s: %s", loc, ve.Message))
+		return
+	}
+
+	for _, cause := range ve.Causes {
+		collectSchemaErrors(cause, res)
+	}
+}
@@ -0,0 +1,71 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSchemaMiddleware(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "email.json")
+	assert.Nil(t, os.WriteFile(file, []byte(`{
+  "type": "object",
+  "required": ["to"],
+  "properties": {"to": {"type": "string"}},
+  "additionalProperties": false
+}`), 0600))
+
+	mid, err := NewSchemaMid([]byte(`
+asynq:
+  schema:
+    enabled: true
+    tasks:
+      email:deliver: ` + file + `
+`))
+	assert.Nil(t, err)
+
+	handled := 0
+	h := mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		handled++
+		return nil
+	}))
+
+	before := counterValue("schema_invalid_total", "email:deliver")
+
+	// fields injected by this package are ignored
+	payload, err := SetPayloadVersion([]byte(`{"to":"a@b.c","traceHeader":{}}`), 2)
+	assert.Nil(t, err)
+	assert.Nil(t, h.ProcessTask(context.Background(), asynq.NewTask("email:deliver", payload)))
+	assert.Equal(t, 1, handled)
+
+	// schema mismatch is not retried
+	err = h.ProcessTask(context.Background(), asynq.NewTask("email:deliver", []byte(`{"to":1,"cc":"x"}`)))
+	assert.True(t, errors.Is(err, asynq.SkipRetry))
+	assert.False(t, errors.Is(err, ErrUndecodable))
+	assert.Contains(t, err.Error(), "/to")
+	assert.Equal(t, before+1, counterValue("schema_invalid_total", "email:deliver"))
+
+	// invalid json is undecodable
+	err = h.ProcessTask(context.Background(), asynq.NewTask("email:deliver", []byte(`{"to"`)))
+	assert.True(t, errors.Is(err, ErrUndecodable))
+	assert.True(t, errors.Is(err, asynq.SkipRetry))
+
+	// task type without schema is passed as it is
+	assert.Nil(t, h.ProcessTask(context.Background(), asynq.NewTask("email:other", []byte(`plain`))))
+	assert.Equal(t, 2, handled)
+}
+
+func TestNewSchemaMid_InvalidSchema(t *testing.T) {
+	_, err := NewSchemaMid([]byte(`
+asynq:
+  schema:
+    enabled: true
+    tasks:
+      email:deliver: not-exist.json
+`))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,69 @@
+package rkasynq
+
+import (
+	"fmt"
+	rkentry "github.com/rookie-ninja/rk-entry/v2/entry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const sharedTraceKeyPrefix = "rk-asynq-shared-trace-"
+
+// SharedTrace is a trace setup shared between asynq middleware and other middlewares in the same process,
+// for example HTTP or gRPC trace middleware of rk-boot.
+type SharedTrace struct {
+	Provider   oteltrace.TracerProvider
+	Propagator propagation.TextMapPropagator
+}
+
+// RegisterSharedTrace register a named trace setup into rkentry.GlobalAppCtx,
+// so that middleware configured with asynq.trace.shared.name could reuse it.
+func RegisterSharedTrace(name string, provider oteltrace.TracerProvider, propagator propagation.TextMapPropagator) {
+	rkentry.GlobalAppCtx.AddValue(sharedTraceKeyPrefix+name, &SharedTrace{
+		Provider:   provider,
+		Propagator: propagator,
+	})
+}
+
+// GetSharedTrace returns named trace setup from rkentry.GlobalAppCtx.
+//
+// If name is empty, then provider and propagator registered in otel global will be used.
+func GetSharedTrace(name string) (*SharedTrace, error) {
+	if len(name) < 1 {
+		res := &SharedTrace{
+			Provider: otel.GetTracerProvider(),
+		}
+
+		// otel global propagator is an empty composite propagator unless user set it
+		if p := otel.GetTextMapPropagator(); len(p.Fields()) > 0 {
+			res.Propagator = p
+		}
+
+		return res, nil
+	}
+
+	switch v := rkentry.GlobalAppCtx.GetValue(sharedTraceKeyPrefix + name).(type) {
+	case *SharedTrace:
+		if v.Provider == nil {
+			return nil, fmt.Errorf("shared trace %s has nil provider", name)
+		}
+		return v, nil
+	case oteltrace.TracerProvider:
+		return &SharedTrace{Provider: v}, nil
+	}
+
+	return nil, fmt.Errorf("shared trace %s not found in GlobalAppCtx", name)
+}
+
+// WithSharedTrace reuse provider and propagator instead of creating private one.
+func WithSharedTrace(shared *SharedTrace) Option {
+	return func(opt *TraceMiddleware) {
+		if shared != nil {
+			opt.shared = shared.Provider
+			if shared.Propagator != nil {
+				opt.propagator = shared.Propagator
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package rkasynq
+
+import (
+	"context"
+	"github.com/hibiken/asynq"
+	rkentry "github.com/rookie-ninja/rk-entry/v2/entry"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+func TestGetSharedTrace_Global(t *testing.T) {
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	defer func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	}()
+
+	// empty global propagator is ignored
+	shared, err := GetSharedTrace("")
+	assert.Nil(t, err)
+	assert.NotNil(t, shared.Provider)
+	assert.Nil(t, shared.Propagator)
+
+	global := sdktrace.NewTracerProvider()
+	otel.SetTracerProvider(global)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	shared, err = GetSharedTrace("")
+	assert.Nil(t, err)
+	assert.Equal(t, global, shared.Provider)
+	assert.Equal(t, propagation.TraceContext{}, shared.Propagator)
+}
+
+func TestGetSharedTrace_Named(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	RegisterSharedTrace("shared-test", provider, propagation.Baggage{})
+
+	shared, err := GetSharedTrace("shared-test")
+	assert.Nil(t, err)
+	assert.Equal(t, provider, shared.Provider)
+	assert.Equal(t, propagation.Baggage{}, shared.Propagator)
+
+	// provider registered by others directly
+	rkentry.GlobalAppCtx.AddValue(sharedTraceKeyPrefix+"shared-test-provider", provider)
+	shared, err = GetSharedTrace("shared-test-provider")
+	assert.Nil(t, err)
+	assert.Equal(t, provider, shared.Provider)
+	assert.Nil(t, shared.Propagator)
+
+	RegisterSharedTrace("shared-test-nil", nil, nil)
+	_, err = GetSharedTrace("shared-test-nil")
+	assert.NotNil(t, err)
+
+	_, err = GetSharedTrace("shared-test-unknown")
+	assert.NotNil(t, err)
+}
+
+func TestNewJaegerMid_Shared(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	RegisterSharedTrace("shared-test-mid", sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)), nil)
+
+	mid, err := NewJaegerMid([]byte(`
+asynq:
+  trace:
+    enabled: true
+    serviceName: worker
+    shared:
+      enabled: true
+      name: shared-test-mid
+`))
+	assert.Nil(t, err)
+
+	var traceId string
+	h := mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		traceId = GetTraceId(ctx)
+		return nil
+	}))
+	assert.Nil(t, h.ProcessTask(context.Background(), asynq.NewTask("shared:test", []byte(`{}`))))
+
+	// span is exported through shared provider
+	spans := recorder.Ended()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, traceId, spans[0].SpanContext().TraceID().String())
+
+	_, err = NewJaegerMid([]byte(`
+asynq:
+  trace:
+    enabled: true
+    shared:
+      enabled: true
+      name: shared-test-unknown
+`))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,234 @@
+package rkasynq
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"gopkg.in/yaml.v3"
+	"net/http"
+)
+
+const (
+	SignatureValid      = "valid"
+	SignatureUnsigned   = "unsigned"
+	SignatureUnknownKey = "unknown_key"
+	SignatureInvalid    = "invalid"
+)
+
+// SigningConfig defines named HMAC secrets.
+//
+// Secret is base64 encoded, loaded from file or environment variable.
+// Producers sign with activeSecret, consumers verify with secret named in envelope.
+// Unsigned tasks are rejected unless allowUnsigned is true, which could be used during rollout.
+//
+// Example:
+//
+//	asynq:
+//	  signing:
+//	    enabled: true
+//	    activeSecret: team-a
+//	    allowUnsigned: false
+//	    secrets:
+//	      - name: team-a
+//	        env: ASYNQ_SECRET_TEAM_A
+//	      - name: team-b
+//	        file: /etc/asynq/team-b.secret
+type SigningConfig struct {
+	Asynq struct {
+		Signing struct {
+			Enabled       bool   `yaml:"enabled" json:"enabled"`
+			ActiveSecret  string `yaml:"activeSecret" json:"activeSecret"`
+			AllowUnsigned bool   `yaml:"allowUnsigned" json:"allowUnsigned"`
+			Secrets       []struct {
+				Name string `yaml:"name" json:"name"`
+				File string `yaml:"file" json:"file"`
+				Env  string `yaml:"env" json:"env"`
+			} `yaml:"secrets" json:"secrets"`
+		} `yaml:"signing" json:"signing"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// signedPayload carries signature over task type, trace header and body
+type signedPayload struct {
+	TraceHeader http.Header `json:"traceHeader,omitempty"`
+	Signature   struct {
+		Name  string `json:"name"`
+		Value []byte `json:"value"`
+	} `json:"rkSignature"`
+	Body []byte `json:"body"`
+}
+
+// NewSigner create Signer from config, used by both producers and SigningMiddleware.
+func NewSigner(raw []byte) (*Signer, error) {
+	conf := &SigningConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	c := conf.Asynq.Signing
+
+	s := &Signer{
+		enabled:       c.Enabled,
+		activeSecret:  c.ActiveSecret,
+		allowUnsigned: c.AllowUnsigned,
+		secrets:       map[string][]byte{},
+	}
+
+	if !s.enabled {
+		return s, nil
+	}
+
+	for _, v := range c.Secrets {
+		secret, err := loadKey(v.File, v.Env)
+		if err != nil {
+			return nil, fmt.Errorf("load signing secret %s failed: %v", v.Name, err)
+		}
+		s.secrets[v.Name] = secret
+	}
+
+	return s, nil
+}
+
+// Signer sign and verify payload with HMAC-SHA256
+type Signer struct {
+	enabled       bool
+	activeSecret  string
+	allowUnsigned bool
+	secrets       map[string][]byte
+}
+
+// Sign returns envelope of payload signed with active secret, trace header is copied from payload.
+func (s *Signer) Sign(typeName string, payload []byte) ([]byte, error) {
+	if !s.enabled {
+		return payload, nil
+	}
+
+	secret, ok := s.secrets[s.activeSecret]
+	if !ok {
+		return nil, fmt.Errorf("active signing secret %s not found", s.activeSecret)
+	}
+
+	res := &signedPayload{
+		TraceHeader: readTraceHeader(payload),
+		Body:        payload,
+	}
+
+	sig, err := signature(secret, typeName, res.TraceHeader, res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Signature.Name = s.activeSecret
+	res.Signature.Value = sig
+
+	return json.Marshal(res)
+}
+
+// NewTask create traced task with signed payload, see NewTracedTask
+func (s *Signer) NewTask(ctx context.Context, typeName string, payload []byte, opts ...asynq.Option) (*asynq.Task, error) {
+	payload, err := InjectTraceHeader(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if payload, err = s.Sign(typeName, payload); err != nil {
+		return nil, err
+	}
+
+	return asynq.NewTask(typeName, payload, opts...), nil
+}
+
+// verify returns body and result of verification
+func (s *Signer) verify(typeName string, payload []byte) ([]byte, string, string) {
+	var p signedPayload
+	if err := json.Unmarshal(payload, &p); err != nil || len(p.Signature.Name) < 1 {
+		return payload, "", SignatureUnsigned
+	}
+
+	secret, ok := s.secrets[p.Signature.Name]
+	if !ok {
+		return nil, p.Signature.Name, SignatureUnknownKey
+	}
+
+	expected, err := signature(secret, typeName, p.TraceHeader, p.Body)
+	if err != nil || !hmac.Equal(expected, p.Signature.Value) {
+		return nil, p.Signature.Name, SignatureInvalid
+	}
+
+	return p.Body, p.Signature.Name, SignatureValid
+}
+
+// signature of task type, trace header and body, header is encoded with sorted keys by encoding/json
+func signature(secret []byte, typeName string, header http.Header, body []byte) ([]byte, error) {
+	// empty header is omitted in envelope
+	rawHeader := []byte("{}")
+	if len(header) > 0 {
+		var err error
+		if rawHeader, err = json.Marshal(header); err != nil {
+			return nil, err
+		}
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	for _, part := range [][]byte{[]byte(typeName), rawHeader, body} {
+		// length prefix avoids ambiguity between parts
+		mac.Write([]byte(fmt.Sprintf("%d:", len(part))))
+		mac.Write(part)
+	}
+
+	return mac.Sum(nil), nil
+}
+
+// NewSigningMid create middleware which rejects unsigned or tampered tasks with SkipRetry.
+//
+// Middleware should be placed after TraceMiddleware so that verification result is recorded on span.
+// Verified task carries body only and has no ResultWriter, see GetResultWriter.
+func NewSigningMid(raw []byte) (asynq.MiddlewareFunc, error) {
+	s, err := NewSigner(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	mid := &SigningMiddleware{
+		signer: s,
+	}
+
+	return mid.Middleware, nil
+}
+
+type SigningMiddleware struct {
+	signer *Signer
+}
+
+func (m *SigningMiddleware) Middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if !m.signer.enabled {
+			return h.ProcessTask(ctx, t)
+		}
+
+		body, name, result := m.signer.verify(t.Type(), t.Payload())
+
+		span := GetSpan(ctx)
+		span.SetAttributes(
+			attribute.String("asynq.signature.result", result),
+			attribute.String("asynq.signature.name", name))
+		incCounter("signature_verification_total", []string{"type", "result"}, t.Type(), result)
+
+		switch {
+		case result == SignatureValid:
+			ctx, t = replacePayload(ctx, t, body)
+		case result == SignatureUnsigned && m.signer.allowUnsigned:
+		default:
+			err := fmt.Errorf("signature verification failed: %s: %w", result, asynq.SkipRetry)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
+		return h.ProcessTask(ctx, t)
+	})
+}
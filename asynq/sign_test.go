@@ -0,0 +1,147 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// verifyWith run task through middleware and returns payload received by handler
+func verifyWith(mid asynq.MiddlewareFunc, typeName string, payload []byte) ([]byte, error) {
+	var res []byte
+	err := mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		res = t.Payload()
+		return nil
+	})).ProcessTask(context.Background(), asynq.NewTask(typeName, payload))
+
+	return res, err
+}
+
+func TestSigningMiddleware(t *testing.T) {
+	t.Setenv("TEST_ASYNQ_TEAM_A", "dGVhbS1h")
+	t.Setenv("TEST_ASYNQ_TEAM_B", "dGVhbS1i")
+
+	signer, err := NewSigner([]byte(`
+asynq:
+  signing:
+    enabled: true
+    activeSecret: team-a
+    secrets:
+      - name: team-a
+        env: TEST_ASYNQ_TEAM_A
+`))
+	assert.Nil(t, err)
+
+	original := []byte(`{"traceHeader":{"Traceparent":["00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"]},"amount":1}`)
+	payload, err := signer.Sign("sign:test", original)
+	assert.Nil(t, err)
+
+	newMid := func(raw string) asynq.MiddlewareFunc {
+		mid, err := NewSigningMid([]byte(raw))
+		assert.Nil(t, err)
+		return mid
+	}
+
+	mid := newMid(`
+asynq:
+  signing:
+    enabled: true
+    activeSecret: team-b
+    secrets:
+      - name: team-a
+        env: TEST_ASYNQ_TEAM_A
+      - name: team-b
+        env: TEST_ASYNQ_TEAM_B
+`)
+
+	// expectRejected asserts payload is rejected with result
+	expectRejected := func(t *testing.T, mid asynq.MiddlewareFunc, typeName string, payload []byte, result string) {
+		before := counterValue("signature_verification_total", typeName, result)
+
+		res, err := verifyWith(mid, typeName, payload)
+		assert.Nil(t, res)
+		assert.True(t, errors.Is(err, asynq.SkipRetry))
+		assert.Contains(t, err.Error(), result)
+		assert.Equal(t, before+1, counterValue("signature_verification_total", typeName, result))
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		before := counterValue("signature_verification_total", "sign:test", SignatureValid)
+
+		res, err := verifyWith(mid, "sign:test", payload)
+		assert.Nil(t, err)
+		assert.Equal(t, original, res)
+		assert.Equal(t, before+1, counterValue("signature_verification_total", "sign:test", SignatureValid))
+	})
+
+	t.Run("Unsigned", func(t *testing.T) {
+		expectRejected(t, mid, "sign:test", original, SignatureUnsigned)
+
+		allowed := newMid(`
+asynq:
+  signing:
+    enabled: true
+    allowUnsigned: true
+    secrets:
+      - name: team-a
+        env: TEST_ASYNQ_TEAM_A
+`)
+		res, err := verifyWith(allowed, "sign:test", original)
+		assert.Nil(t, err)
+		assert.Equal(t, original, res)
+
+		// tampered task is rejected even if unsigned tasks are allowed
+		tampered := editEnvelope(t, payload, func(m map[string]interface{}) { m["body"] = "e30=" })
+		expectRejected(t, allowed, "sign:test", tampered, SignatureInvalid)
+	})
+
+	t.Run("RotatedOutSecret", func(t *testing.T) {
+		rotated := newMid(`
+asynq:
+  signing:
+    enabled: true
+    activeSecret: team-b
+    secrets:
+      - name: team-b
+        env: TEST_ASYNQ_TEAM_B
+`)
+		expectRejected(t, rotated, "sign:test", payload, SignatureUnknownKey)
+	})
+
+	t.Run("UnknownSecret", func(t *testing.T) {
+		tampered := editEnvelope(t, payload, func(m map[string]interface{}) {
+			m["rkSignature"].(map[string]interface{})["name"] = "team-z"
+		})
+		expectRejected(t, mid, "sign:test", tampered, SignatureUnknownKey)
+	})
+
+	t.Run("SwappedSecret", func(t *testing.T) {
+		tampered := editEnvelope(t, payload, func(m map[string]interface{}) {
+			m["rkSignature"].(map[string]interface{})["name"] = "team-b"
+		})
+		expectRejected(t, mid, "sign:test", tampered, SignatureInvalid)
+	})
+
+	t.Run("ModifiedTraceHeader", func(t *testing.T) {
+		tampered := editEnvelope(t, payload, func(m map[string]interface{}) {
+			m["traceHeader"] = map[string]interface{}{
+				"Traceparent": []string{"00-11111111111111111111111111111111-2222222222222222-01"},
+			}
+		})
+		expectRejected(t, mid, "sign:test", tampered, SignatureInvalid)
+
+		stripped := editEnvelope(t, payload, func(m map[string]interface{}) { delete(m, "traceHeader") })
+		expectRejected(t, mid, "sign:test", stripped, SignatureInvalid)
+	})
+
+	t.Run("ModifiedBody", func(t *testing.T) {
+		tampered := editEnvelope(t, payload, func(m map[string]interface{}) { m["body"] = "e30=" })
+		expectRejected(t, mid, "sign:test", tampered, SignatureInvalid)
+	})
+
+	t.Run("OtherType", func(t *testing.T) {
+		expectRejected(t, mid, "sign:other", payload, SignatureInvalid)
+	})
+}
@@ -0,0 +1,86 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// TaskTrace is trace context decoded from traceHeader of task
+type TaskTrace struct {
+	TaskId  string            `json:"taskId"`
+	Queue   string            `json:"queue"`
+	Type    string            `json:"type"`
+	State   string            `json:"state"`
+	TraceId string            `json:"traceId"`
+	SpanId  string            `json:"spanId"`
+	Sampled bool              `json:"sampled"`
+	Baggage map[string]string `json:"baggage"`
+}
+
+// LookupTaskTrace fetch task in any state and decode its traceHeader with propagator of shared trace
+// with traceName, see GetSharedTrace.
+//
+// Every queue is searched if queue is empty. TraceId and SpanId are empty if task is not traced.
+func LookupTaskTrace(inspector *asynq.Inspector, traceName, queue, id string) (*TaskTrace, error) {
+	shared, err := GetSharedTrace(traceName)
+	if err != nil {
+		return nil, err
+	}
+
+	propagator := shared.Propagator
+	if propagator == nil {
+		propagator = newDefaultPropagator()
+	}
+
+	info, err := findTask(inspector, queue, id)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := propagator.Extract(context.Background(), propagation.HeaderCarrier(readTraceHeader(info.Payload)))
+	spanCtx := oteltrace.SpanContextFromContext(ctx)
+
+	res := &TaskTrace{
+		TaskId:  info.ID,
+		Queue:   info.Queue,
+		Type:    info.Type,
+		State:   info.State.String(),
+		Sampled: spanCtx.IsSampled(),
+		Baggage: GetAllBaggage(ctx),
+	}
+
+	if spanCtx.HasTraceID() {
+		res.TraceId = spanCtx.TraceID().String()
+	}
+
+	if spanCtx.HasSpanID() {
+		res.SpanId = spanCtx.SpanID().String()
+	}
+
+	return res, nil
+}
+
+func findTask(inspector *asynq.Inspector, queue, id string) (*asynq.TaskInfo, error) {
+	if len(queue) > 0 {
+		return inspector.GetTaskInfo(queue, id)
+	}
+
+	queues, err := inspector.Queues()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, q := range queues {
+		info, err := inspector.GetTaskInfo(q, id)
+		if errors.Is(err, asynq.ErrTaskNotFound) {
+			continue
+		}
+
+		return info, err
+	}
+
+	return nil, asynq.ErrTaskNotFound
+}
@@ -0,0 +1,75 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"testing"
+)
+
+func TestLookupTaskTrace(t *testing.T) {
+	_, opt, _ := newTestRedis(t)
+
+	provider := sdktrace.NewTracerProvider()
+	RegisterSharedTrace("lookup-test", provider, nil)
+
+	client := asynq.NewClient(opt)
+	defer client.Close()
+	inspector := asynq.NewInspector(opt)
+	defer inspector.Close()
+
+	ctx, span := provider.Tracer("test").Start(context.Background(), "producer")
+	defer span.End()
+	ctx, err := SetBaggage(ctx, "tenant", "acme")
+	assert.Nil(t, err)
+
+	claimCheck, err := NewClaimCheck([]byte(`
+asynq:
+  claimCheck:
+    enabled: true
+    threshold: 1
+    file:
+      dir: `+t.TempDir()+`
+`), nil)
+	assert.Nil(t, err)
+
+	traced, err := NewTracedTask(ctx, "lookup:test", []byte(`{"id":1}`))
+	assert.Nil(t, err)
+	offloaded, err := claimCheck.NewTask(ctx, "lookup:test", []byte(`{"id":2}`))
+	assert.Nil(t, err)
+
+	for _, task := range []*asynq.Task{traced, offloaded} {
+		info, err := client.Enqueue(task, asynq.Queue("traced"))
+		assert.Nil(t, err)
+
+		// every queue is searched if queue is empty
+		res, err := LookupTaskTrace(inspector, "lookup-test", "", info.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, info.ID, res.TaskId)
+		assert.Equal(t, "traced", res.Queue)
+		assert.Equal(t, "pending", res.State)
+		assert.Equal(t, span.SpanContext().TraceID().String(), res.TraceId)
+		assert.Equal(t, span.SpanContext().SpanID().String(), res.SpanId)
+		assert.True(t, res.Sampled)
+		assert.Equal(t, map[string]string{"tenant": "acme"}, res.Baggage)
+	}
+
+	// task without trace header
+	info, err := client.Enqueue(asynq.NewTask("lookup:test", []byte(`plain`)))
+	assert.Nil(t, err)
+
+	res, err := LookupTaskTrace(inspector, "lookup-test", "default", info.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, info.ID, res.TaskId)
+	assert.Empty(t, res.TraceId)
+	assert.Empty(t, res.SpanId)
+	assert.False(t, res.Sampled)
+
+	_, err = LookupTaskTrace(inspector, "lookup-test", "", "missing")
+	assert.True(t, errors.Is(err, asynq.ErrTaskNotFound))
+
+	_, err = LookupTaskTrace(inspector, "not-registered", "", info.ID)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,125 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+	"time"
+)
+
+// TimeoutConfig defines per task type execution budget.
+//
+// Example:
+//
+//	asynq:
+//	  timeout:
+//	    enabled: true
+//	    default: 30s
+//	    skipRetry: false
+//	    tasks:
+//	      email:send: 10s
+type TimeoutConfig struct {
+	Asynq struct {
+		Timeout struct {
+			Enabled   bool              `yaml:"enabled" json:"enabled"`
+			Default   string            `yaml:"default" json:"default"`
+			SkipRetry bool              `yaml:"skipRetry" json:"skipRetry"`
+			Tasks     map[string]string `yaml:"tasks" json:"tasks"`
+		} `yaml:"timeout" json:"timeout"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// NewTimeoutMid create middleware which applies context deadline before handler runs.
+//
+// Middleware should be placed after TraceMiddleware, so that deadline event could be recorded on span.
+func NewTimeoutMid(raw []byte) (asynq.MiddlewareFunc, error) {
+	conf := &TimeoutConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	mid := &TimeoutMiddleware{
+		enabled:   conf.Asynq.Timeout.Enabled,
+		skipRetry: conf.Asynq.Timeout.SkipRetry,
+		budgets:   map[string]time.Duration{},
+	}
+
+	if len(conf.Asynq.Timeout.Default) > 0 {
+		d, err := time.ParseDuration(conf.Asynq.Timeout.Default)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default timeout: %v", err)
+		}
+		mid.defaultBudget = d
+	}
+
+	for k, v := range conf.Asynq.Timeout.Tasks {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout of task %s: %v", k, err)
+		}
+		mid.budgets[k] = d
+	}
+
+	return mid.Middleware, nil
+}
+
+type TimeoutMiddleware struct {
+	enabled       bool
+	skipRetry     bool
+	defaultBudget time.Duration
+	budgets       map[string]time.Duration
+}
+
+func (m *TimeoutMiddleware) Middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		budget := m.budget(t.Type())
+		if !m.enabled || budget <= 0 {
+			return h.ProcessTask(ctx, t)
+		}
+
+		parent := ctx
+		ctx, cancel := context.WithTimeout(ctx, budget)
+		defer cancel()
+
+		err := h.ProcessTask(ctx, t)
+
+		// deadline of parent context is owned by asynq server, ignore it
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) || parent.Err() != nil {
+			return err
+		}
+
+		span := GetSpan(ctx)
+		span.AddEvent("deadline_exceeded", oteltrace.WithAttributes(
+			attribute.String("asynq.task.type", t.Type()),
+			attribute.String("asynq.timeout.budget", budget.String()),
+			attribute.Bool("asynq.timeout.skipRetry", m.skipRetry),
+		))
+
+		if err == nil {
+			// handler finished successfully but ignored deadline
+			return nil
+		}
+
+		span.SetStatus(codes.Error, fmt.Sprintf("task exceeded budget %s", budget))
+
+		// error of handler is kept in chain, so that its own class is still matched
+		if m.skipRetry {
+			return fmt.Errorf("task exceeded budget %s: %w: %w", budget, err, asynq.SkipRetry)
+		}
+
+		return fmt.Errorf("task exceeded budget %s: %w: %w", budget, err, context.DeadlineExceeded)
+	})
+}
+
+func (m *TimeoutMiddleware) budget(taskType string) time.Duration {
+	if v, ok := m.budgets[taskType]; ok {
+		return v
+	}
+
+	return m.defaultBudget
+}
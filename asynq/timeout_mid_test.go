@@ -0,0 +1,117 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	"testing"
+	"time"
+)
+
+func newTestTimeoutMid(t *testing.T, skipRetry bool) asynq.MiddlewareFunc {
+	mid, err := NewTimeoutMid([]byte(fmt.Sprintf(`
+asynq:
+  timeout:
+    enabled: true
+    default: 1h
+    skipRetry: %v
+    tasks:
+      timeout:test: 20ms
+`, skipRetry)))
+	assert.Nil(t, err)
+
+	return mid
+}
+
+// errTimeoutHandler is returned by handler which waits for deadline
+var errTimeoutHandler = errors.New("handler gave up")
+
+// waitHandler returns errTimeoutHandler wrapping ctx.Err() once ctx is done
+var waitHandler = asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+	<-ctx.Done()
+	return fmt.Errorf("%w: %w", errTimeoutHandler, ctx.Err())
+})
+
+func TestTimeoutMiddleware_BudgetExceeded(t *testing.T) {
+	ctx, end := newRecordedContext()
+
+	err := newTestTimeoutMid(t, false)(waitHandler).ProcessTask(ctx, asynq.NewTask("timeout:test", nil))
+	span := end()
+
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, errors.Is(err, errTimeoutHandler))
+	assert.False(t, errors.Is(err, asynq.SkipRetry))
+	assert.Equal(t, ErrorClassDeadline, ClassifyError(err))
+
+	assert.True(t, hasEvent(span, "deadline_exceeded"))
+	assert.Equal(t, codes.Error, span.Status().Code)
+}
+
+func TestTimeoutMiddleware_SkipRetry(t *testing.T) {
+	ctx, end := newRecordedContext()
+
+	err := newTestTimeoutMid(t, true)(waitHandler).ProcessTask(ctx, asynq.NewTask("timeout:test", nil))
+	span := end()
+
+	assert.True(t, errors.Is(err, asynq.SkipRetry))
+	assert.True(t, errors.Is(err, errTimeoutHandler))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, hasEvent(span, "deadline_exceeded"))
+}
+
+func TestTimeoutMiddleware_HandlerErrorKept(t *testing.T) {
+	// handler decides not to retry after deadline
+	h := asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		<-ctx.Done()
+		return &PanicError{Value: "boom"}
+	})
+
+	err := newTestTimeoutMid(t, false)(h).ProcessTask(context.Background(), asynq.NewTask("timeout:test", nil))
+	assert.True(t, IsPanic(err))
+	assert.Equal(t, ErrorClassPanic, ClassifyError(err))
+}
+
+func TestTimeoutMiddleware_ParentDeadline(t *testing.T) {
+	ctx, end := newRecordedContext()
+
+	// deadline of asynq server is shorter than budget
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+
+	err := newTestTimeoutMid(t, true)(waitHandler).ProcessTask(ctx, asynq.NewTask("timeout:other", nil))
+	span := end()
+
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.False(t, errors.Is(err, asynq.SkipRetry))
+	assert.False(t, hasEvent(span, "deadline_exceeded"))
+}
+
+func TestTimeoutMiddleware_Success(t *testing.T) {
+	ctx, end := newRecordedContext()
+
+	// handler ignores deadline and succeeds
+	h := asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		<-ctx.Done()
+		return nil
+	})
+
+	assert.Nil(t, newTestTimeoutMid(t, true)(h).ProcessTask(ctx, asynq.NewTask("timeout:test", nil)))
+	span := end()
+
+	assert.True(t, hasEvent(span, "deadline_exceeded"))
+	assert.NotEqual(t, codes.Error, span.Status().Code)
+}
+
+func TestNewTimeoutMid_Invalid(t *testing.T) {
+	_, err := NewTimeoutMid([]byte(`
+asynq:
+  timeout:
+    enabled: true
+    tasks:
+      timeout:test: soon
+`))
+	assert.NotNil(t, err)
+}
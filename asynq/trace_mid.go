@@ -3,6 +3,7 @@ package rkasynq
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/hibiken/asynq"
 	rkentry "github.com/rookie-ninja/rk-entry/v2/entry"
@@ -14,14 +15,14 @@ import (
 	"go.opentelemetry.io/otel/exporters/jaeger"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/propagation"
-	sdkresource "go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 	oteltrace "go.opentelemetry.io/otel/trace"
 	"gopkg.in/yaml.v3"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 )
 
 var (
@@ -43,10 +44,16 @@ type basePayload struct {
 type TraceConfig struct {
 	Asynq struct {
 		Trace struct {
-			Enabled        bool   `yaml:"enabled" json:"enabled"`
-			ServiceName    string `yaml:"serviceName"`
-			ServiceVersion string `yaml:"serviceVersion"`
-			Exporter       struct {
+			Enabled           bool           `yaml:"enabled" json:"enabled"`
+			ServiceName       string         `yaml:"serviceName"`
+			ServiceVersion    string         `yaml:"serviceVersion"`
+			Resource          ResourceConfig `yaml:"resource" json:"resource"`
+			BaggageAttributes []string       `yaml:"baggageAttributes" json:"baggageAttributes"`
+			Shared            struct {
+				Enabled bool   `yaml:"enabled" json:"enabled"`
+				Name    string `yaml:"name" json:"name"`
+			} `yaml:"shared" json:"shared"`
+			Exporter struct {
 				File struct {
 					Enabled    bool   `yaml:"enabled" json:"enabled"`
 					OutputPath string `yaml:"outputPath" json:"outputPath"`
@@ -81,73 +88,97 @@ func NewJaegerMid(traceRaw []byte) (asynq.MiddlewareFunc, error) {
 
 	opts := ToOptions(conf)
 
+	if conf.Asynq.Trace.Shared.Enabled {
+		shared, err := GetSharedTrace(conf.Asynq.Trace.Shared.Name)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithSharedTrace(shared))
+	}
+
 	for i := range opts {
 		opts[i](mid)
 	}
 
-	if mid.exporter == nil {
-		mid.exporter = NewNoopExporter()
-	}
+	if mid.shared != nil {
+		// reuse provider of other middlewares, exporter and processor are owned by them
+		if v, ok := mid.shared.(*sdktrace.TracerProvider); ok {
+			mid.provider = v
+		}
+	} else if mid.provider == nil {
+		if mid.exporter == nil {
+			mid.exporter = NewNoopExporter()
+		}
 
-	if mid.processor == nil {
-		mid.processor = sdktrace.NewBatchSpanProcessor(mid.exporter)
-	}
+		if mid.processor == nil {
+			mid.processor = sdktrace.NewBatchSpanProcessor(mid.exporter)
+		}
+
+		res, err := NewResource(conf.Asynq.Trace.ServiceName, conf.Asynq.Trace.ServiceVersion, &conf.Asynq.Trace.Resource)
+		if err != nil {
+			return nil, err
+		}
 
-	if mid.provider == nil {
 		mid.provider = sdktrace.NewTracerProvider(
 			sdktrace.WithSampler(sdktrace.AlwaysSample()),
 			sdktrace.WithSpanProcessor(mid.processor),
-			sdktrace.WithResource(
-				sdkresource.NewWithAttributes(
-					semconv.SchemaURL,
-					attribute.String("service.name", conf.Asynq.Trace.ServiceName),
-					attribute.String("service.version", conf.Asynq.Trace.ServiceVersion),
-				)),
+			sdktrace.WithResource(res),
 		)
 	}
 
-	mid.tracer = mid.provider.Tracer(conf.Asynq.Trace.ServiceName, oteltrace.WithInstrumentationVersion(contrib.SemVersion()))
+	var provider oteltrace.TracerProvider = mid.provider
+	if mid.shared != nil {
+		provider = mid.shared
+	}
+
+	mid.tracer = provider.Tracer(conf.Asynq.Trace.ServiceName, oteltrace.WithInstrumentationVersion(contrib.SemVersion()))
 
 	if mid.propagator == nil {
-		mid.propagator = propagation.NewCompositeTextMapPropagator(
-			propagation.TraceContext{},
-			propagation.Baggage{})
+		mid.propagator = newDefaultPropagator()
 	}
 
+	mid.baggageKeys = conf.Asynq.Trace.BaggageAttributes
+
 	return mid.Middleware, nil
 }
 
 type TraceMiddleware struct {
-	exporter   sdktrace.SpanExporter
-	processor  sdktrace.SpanProcessor
-	provider   *sdktrace.TracerProvider
-	propagator propagation.TextMapPropagator
-	tracer     oteltrace.Tracer
+	exporter    sdktrace.SpanExporter
+	processor   sdktrace.SpanProcessor
+	provider    *sdktrace.TracerProvider
+	shared      oteltrace.TracerProvider
+	propagator  propagation.TextMapPropagator
+	tracer      oteltrace.Tracer
+	baggageKeys []string
 }
 
 func (m *TraceMiddleware) Middleware(h asynq.Handler) asynq.Handler {
 	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
 		var p basePayload
 		if err := json.Unmarshal(t.Payload(), &p); err != nil {
-			return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+			return fmt.Errorf("json.Unmarshal failed: %v: %w", err, ErrUndecodable)
 		}
 
 		ctx = m.propagator.Extract(ctx, propagation.HeaderCarrier(p.TraceHeader))
 		spanCtx := oteltrace.SpanContextFromContext(ctx)
 
 		// create new span
-		ctx, span := m.tracer.Start(oteltrace.ContextWithRemoteSpanContext(ctx, spanCtx), t.Type())
+		ctx, span := m.tracer.Start(oteltrace.ContextWithRemoteSpanContext(ctx, spanCtx), t.Type(),
+			oteltrace.WithLinks(m.links(readTraceLinks(t.Payload()))...))
 		defer span.End()
 
+		span.SetAttributes(baggageAttributes(ctx, m.baggageKeys)...)
+
 		ctx = context.WithValue(ctx, spanKey, span)
 		ctx = context.WithValue(ctx, traceIdKey, span.SpanContext().TraceID())
 		ctx = context.WithValue(ctx, tracerKey, m.tracer)
 		ctx = context.WithValue(ctx, propagatorKey, m.propagator)
 		ctx = context.WithValue(ctx, providerKey, m.provider)
 
-		err := h.ProcessTask(ctx, t)
+		err := m.process(ctx, h, t)
 
 		if err != nil {
+			recordTaskError(ctx, span, err)
 			span.SetStatus(codes.Error, fmt.Sprintf("%v", err))
 		} else {
 			span.SetStatus(codes.Ok, "success")
@@ -157,6 +188,63 @@ func (m *TraceMiddleware) Middleware(h asynq.Handler) asynq.Handler {
 	})
 }
 
+// links returns span links of trace headers, for example member tasks of aggregated task
+func (m *TraceMiddleware) links(headers []http.Header) []oteltrace.Link {
+	res := make([]oteltrace.Link, 0, len(headers))
+
+	for i := range headers {
+		spanCtx := oteltrace.SpanContextFromContext(
+			m.propagator.Extract(context.Background(), propagation.HeaderCarrier(headers[i])))
+		if spanCtx.IsValid() {
+			res = append(res, oteltrace.Link{SpanContext: spanCtx})
+		}
+	}
+
+	return res
+}
+
+// process run handler and convert panic into PanicError, so that it could be recorded on span
+func (m *TraceMiddleware) process(ctx context.Context, h asynq.Handler, t *asynq.Task) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{
+				Value: v,
+				Stack: string(debug.Stack()),
+			}
+		}
+	}()
+
+	return h.ProcessTask(ctx, t)
+}
+
+// recordTaskError record error class, error chain and whether this attempt is the final one
+func recordTaskError(ctx context.Context, span oteltrace.Span, err error) {
+	class := ClassifyError(err)
+
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+
+	final := finalAttempt(retried, maxRetry, err)
+
+	attrs := []attribute.KeyValue{
+		attribute.String("asynq.error.class", class),
+		attribute.StringSlice("asynq.error.chain", ErrorChain(err)),
+		attribute.Int("asynq.task.retried", retried),
+		attribute.Int("asynq.task.maxRetry", maxRetry),
+		attribute.Bool("asynq.task.finalAttempt", final),
+	}
+
+	span.SetAttributes(attrs...)
+
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		attrs = append(attrs, semconv.ExceptionStacktrace(panicErr.Stack))
+		span.RecordError(err, oteltrace.WithAttributes(attrs...))
+	} else {
+		span.RecordError(err, oteltrace.WithAttributes(attrs...), oteltrace.WithStackTrace(true))
+	}
+}
+
 func GetSpan(ctx context.Context) oteltrace.Span {
 	if v := ctx.Value(spanKey); v != nil {
 		if res, ok := v.(oteltrace.Span); ok {
@@ -218,7 +306,8 @@ func EndSpan(span oteltrace.Span, success bool) {
 func ToOptions(config *TraceConfig) []Option {
 	opts := make([]Option, 0)
 
-	if config.Asynq.Trace.Enabled {
+	// exporter of shared provider is owned by whoever registered it
+	if config.Asynq.Trace.Enabled && !config.Asynq.Trace.Shared.Enabled {
 		var exporter sdktrace.SpanExporter
 
 		if config.Asynq.Trace.Exporter.File.Enabled {
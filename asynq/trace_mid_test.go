@@ -0,0 +1,28 @@
+package rkasynq
+
+import (
+	"context"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTraceMiddleware_TraceLinksOfOtherShape(t *testing.T) {
+	mid, err := NewJaegerMid([]byte(`
+asynq:
+  trace:
+    enabled: true
+`))
+	assert.Nil(t, err)
+
+	calls := 0
+	h := mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		calls++
+		return nil
+	}))
+
+	// traceLinks is a field of user payload, not trace headers
+	task := asynq.NewTask("links", []byte(`{"traceLinks":"https://example.com"}`))
+	assert.Nil(t, h.ProcessTask(context.Background(), task))
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,186 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"gopkg.in/yaml.v3"
+	"strconv"
+	"sync"
+)
+
+const (
+	payloadVersionField = "payloadVersion"
+
+	// defaultPayloadVersion is version of payload without version field
+	defaultPayloadVersion = 1
+)
+
+// UpgradeFunc upgrades payload by one version, version field is updated by middleware
+type UpgradeFunc func(ctx context.Context, payload []byte) ([]byte, error)
+
+var (
+	upgradeLock sync.RWMutex
+	upgrades    = make(map[string]map[int]UpgradeFunc)
+)
+
+// RegisterUpgrade register function which upgrades payload of task type from version to version+1.
+//
+// Upgrades are chained by VersioningMiddleware, for example v1 -> v2 -> v3 with upgrades registered
+// for version 1 and 2. Task which could not reach the latest version because of missing upgrade is failed.
+func RegisterUpgrade(typeName string, from int, fn UpgradeFunc) {
+	if fn == nil {
+		return
+	}
+
+	upgradeLock.Lock()
+	defer upgradeLock.Unlock()
+
+	if _, ok := upgrades[typeName]; !ok {
+		upgrades[typeName] = make(map[int]UpgradeFunc)
+	}
+	upgrades[typeName][from] = fn
+}
+
+func getUpgrade(typeName string, from int) UpgradeFunc {
+	upgradeLock.RLock()
+	defer upgradeLock.RUnlock()
+
+	return upgrades[typeName][from]
+}
+
+// getLatestVersion returns version reached by the last registered upgrade of task type, 0 if none
+func getLatestVersion(typeName string) int {
+	upgradeLock.RLock()
+	defer upgradeLock.RUnlock()
+
+	res := 0
+	for from := range upgrades[typeName] {
+		if from+1 > res {
+			res = from + 1
+		}
+	}
+
+	return res
+}
+
+// SetPayloadVersion returns JSON payload with version field set beside traceHeader
+func SetPayloadVersion(payload []byte, version int) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return nil, err
+		}
+	}
+
+	fields[payloadVersionField] = json.RawMessage(strconv.Itoa(version))
+
+	return json.Marshal(fields)
+}
+
+// GetPayloadVersion returns version of JSON payload, 1 if version field is missing
+func GetPayloadVersion(payload []byte) int {
+	var p struct {
+		Version int `json:"payloadVersion"`
+	}
+
+	if err := json.Unmarshal(payload, &p); err != nil || p.Version < 1 {
+		return defaultPayloadVersion
+	}
+
+	return p.Version
+}
+
+// VersioningConfig enables upgrades registered with RegisterUpgrade.
+//
+// Example:
+//
+//	asynq:
+//	  versioning:
+//	    enabled: true
+type VersioningConfig struct {
+	Asynq struct {
+		Versioning struct {
+			Enabled bool `yaml:"enabled" json:"enabled"`
+		} `yaml:"versioning" json:"versioning"`
+	} `yaml:"asynq" json:"asynq"`
+}
+
+// NewVersioningMid create middleware which upgrades payload to the latest version before handler runs,
+// so that tasks enqueued before deploy keep working.
+//
+// Middleware should be placed after TraceMiddleware and middlewares which unwrap payload,
+// for example decryption and claim-check, and before SchemaMiddleware.
+// Upgraded task has no ResultWriter, see GetResultWriter.
+func NewVersioningMid(raw []byte) (asynq.MiddlewareFunc, error) {
+	conf := &VersioningConfig{}
+	if err := yaml.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+
+	mid := &VersioningMiddleware{
+		enabled: conf.Asynq.Versioning.Enabled,
+	}
+
+	return mid.Middleware, nil
+}
+
+type VersioningMiddleware struct {
+	enabled bool
+}
+
+func (m *VersioningMiddleware) Middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if !m.enabled {
+			return h.ProcessTask(ctx, t)
+		}
+
+		from := GetPayloadVersion(t.Payload())
+		latest := getLatestVersion(t.Type())
+		if from >= latest {
+			return h.ProcessTask(ctx, t)
+		}
+
+		payload, to, err := upgradePayload(ctx, t.Type(), from, t.Payload())
+		if err == nil && to < latest {
+			err = fmt.Errorf("no upgrade registered, latest version is %d", latest)
+		}
+
+		span := GetSpan(ctx)
+		span.SetAttributes(
+			attribute.Int("asynq.payload.version.from", from),
+			attribute.Int("asynq.payload.version.to", to))
+
+		if err != nil {
+			// upgrade is deterministic, retry won't help
+			err = fmt.Errorf("upgrade payload from version %d failed: %v: %w", to, err, asynq.SkipRetry)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
+		ctx, t = replacePayload(ctx, t, payload)
+		return h.ProcessTask(ctx, t)
+	})
+}
+
+// upgradePayload applies upgrades until no upgrade is registered for current version,
+// returns payload and version reached, which is the failed version if error occurs.
+func upgradePayload(ctx context.Context, typeName string, version int, payload []byte) ([]byte, int, error) {
+	for fn := getUpgrade(typeName, version); fn != nil; fn = getUpgrade(typeName, version) {
+		res, err := fn(ctx, payload)
+		if err != nil {
+			return nil, version, err
+		}
+
+		if payload, err = SetPayloadVersion(res, version+1); err != nil {
+			return nil, version, err
+		}
+		version++
+	}
+
+	return payload, version, nil
+}
@@ -0,0 +1,109 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPayloadVersion(t *testing.T) {
+	assert.Equal(t, 1, GetPayloadVersion([]byte(`{"id":1}`)))
+	assert.Equal(t, 1, GetPayloadVersion([]byte(`plain`)))
+
+	payload, err := SetPayloadVersion([]byte(`{"id":1,"traceHeader":{}}`), 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, GetPayloadVersion(payload))
+	assert.Contains(t, string(payload), `"traceHeader":{}`)
+
+	_, err = SetPayloadVersion([]byte(`plain`), 2)
+	assert.NotNil(t, err)
+}
+
+func TestVersioningMiddleware(t *testing.T) {
+	// v1 renames name to fullName, v2 adds locale, no upgrade for v3
+	RegisterUpgrade("version:user", 1, func(ctx context.Context, payload []byte) ([]byte, error) {
+		fields := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return nil, err
+		}
+		fields["fullName"] = fields["name"]
+		delete(fields, "name")
+		return json.Marshal(fields)
+	})
+	RegisterUpgrade("version:user", 2, func(ctx context.Context, payload []byte) ([]byte, error) {
+		fields := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return nil, err
+		}
+		fields["locale"] = json.RawMessage(`"en"`)
+		return json.Marshal(fields)
+	})
+	RegisterUpgrade("version:broken", 1, func(ctx context.Context, payload []byte) ([]byte, error) {
+		return nil, errors.New("broken")
+	})
+
+	mid, err := NewVersioningMid([]byte(`
+asynq:
+  versioning:
+    enabled: true
+`))
+	assert.Nil(t, err)
+
+	var received []byte
+	h := mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		received = t.Payload()
+		return nil
+	}))
+
+	// payload without version is upgraded through v1 -> v2 -> v3
+	assert.Nil(t, h.ProcessTask(context.Background(), asynq.NewTask("version:user", []byte(`{"name":"a"}`))))
+	assert.JSONEq(t, `{"fullName":"a","locale":"en","payloadVersion":3}`, string(received))
+
+	// payload of version 2 is upgraded by one version
+	payload, err := SetPayloadVersion([]byte(`{"fullName":"a"}`), 2)
+	assert.Nil(t, err)
+	assert.Nil(t, h.ProcessTask(context.Background(), asynq.NewTask("version:user", payload)))
+	assert.JSONEq(t, `{"fullName":"a","locale":"en","payloadVersion":3}`, string(received))
+
+	// no upgrade registered for the latest version, payload is passed as it is
+	payload, err = SetPayloadVersion([]byte(`{"fullName":"a","locale":"fr"}`), 3)
+	assert.Nil(t, err)
+	assert.Nil(t, h.ProcessTask(context.Background(), asynq.NewTask("version:user", payload)))
+	assert.Equal(t, payload, received)
+
+	// task type without upgrades is passed as it is
+	assert.Nil(t, h.ProcessTask(context.Background(), asynq.NewTask("version:other", []byte(`{"name":"a"}`))))
+	assert.Equal(t, []byte(`{"name":"a"}`), received)
+
+	// failed upgrade is not retried
+	received = nil
+	err = h.ProcessTask(context.Background(), asynq.NewTask("version:broken", []byte(`{}`)))
+	assert.True(t, errors.Is(err, asynq.SkipRetry))
+	assert.Nil(t, received)
+
+	// missing upgrade from version 2 to 3, task could not reach the latest version
+	RegisterUpgrade("version:gap", 1, func(ctx context.Context, payload []byte) ([]byte, error) { return payload, nil })
+	RegisterUpgrade("version:gap", 3, func(ctx context.Context, payload []byte) ([]byte, error) { return payload, nil })
+
+	err = h.ProcessTask(context.Background(), asynq.NewTask("version:gap", []byte(`{}`)))
+	assert.True(t, errors.Is(err, asynq.SkipRetry))
+	assert.Contains(t, err.Error(), "from version 2")
+	assert.Nil(t, received)
+
+	payload, err = SetPayloadVersion([]byte(`{}`), 3)
+	assert.Nil(t, err)
+	assert.Nil(t, h.ProcessTask(context.Background(), asynq.NewTask("version:gap", payload)))
+	assert.Equal(t, 4, GetPayloadVersion(received))
+
+	// disabled middleware does not upgrade
+	mid, err = NewVersioningMid(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, mid(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		received = t.Payload()
+		return nil
+	})).ProcessTask(context.Background(), asynq.NewTask("version:user", []byte(`{"name":"a"}`))))
+	assert.Equal(t, []byte(`{"name":"a"}`), received)
+}
@@ -0,0 +1,446 @@
+package rkasynq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hibiken/asynq"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/xid"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWorkflowKeyPrefix = "rk:asynq:workflow:"
+	defaultWorkflowTTL       = 7 * 24 * time.Hour
+)
+
+// WorkflowContext is passed to every step of workflow
+type WorkflowContext struct {
+	Name    string
+	Id      string
+	Input   []byte
+	Results map[string][]byte
+}
+
+// WorkflowStepFunc run step and returns result which is visible to following steps in WorkflowContext.Results
+type WorkflowStepFunc func(ctx context.Context, wf *WorkflowContext) ([]byte, error)
+
+// WorkflowCompensateFunc undo completed step while workflow failed
+type WorkflowCompensateFunc func(ctx context.Context, wf *WorkflowContext) error
+
+// WorkflowFailureFunc is called once compensations finished, with failed step and its error
+type WorkflowFailureFunc func(ctx context.Context, wf *WorkflowContext, step string, reason string) error
+
+// WorkflowStep is a task type of workflow
+type WorkflowStep struct {
+	Type       string
+	Run        WorkflowStepFunc
+	Compensate WorkflowCompensateFunc
+}
+
+// workflowPayload is payload of step and compensation tasks
+type workflowPayload struct {
+	Workflow struct {
+		Name  string `json:"name"`
+		Id    string `json:"id"`
+		Stage int    `json:"stage"`
+	} `json:"workflow"`
+}
+
+// NewWorkflow create workflow whose state is stored in the same redis as asynq.Server.
+//
+// Stages are declared with Then, steps in the same stage run in parallel (fan-out),
+// next stage starts once every step of previous stage completed (fan-in).
+// opts are applied to every step task, for example asynq.Queue or asynq.MaxRetry.
+//
+// Each step enqueues the next stage with trace of its own, so that TraceMiddleware records
+// the whole workflow as one trace.
+//
+// Compensation starts once a step fails in its final attempt, which is decided inside step handler.
+// Middlewares which turn errors into asynq.SkipRetry, for example TimeoutMiddleware with skipRetry,
+// SchemaMiddleware and SigningMiddleware, must be passed to Use instead of asynq.ServeMux,
+// otherwise task may be archived without compensation.
+//
+// Example:
+//
+//	wf, _ := rkasynq.NewWorkflow("order", redisOpt, asynq.MaxRetry(3))
+//	wf.Then(rkasynq.WorkflowStep{Type: "order:charge", Run: charge, Compensate: refund}).
+//		Then(rkasynq.WorkflowStep{Type: "notify:email", Run: email}, rkasynq.WorkflowStep{Type: "notify:sms", Run: sms}).
+//		Then(rkasynq.WorkflowStep{Type: "order:complete", Run: complete}).
+//		OnFailure(alert)
+//	wf.Register(mux)
+//	id, err := wf.Start(ctx, input)
+func NewWorkflow(name string, redisOpt asynq.RedisConnOpt, opts ...asynq.Option) (*Workflow, error) {
+	client, err := NewRedisClient(redisOpt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Workflow{
+		name:      name,
+		redis:     client,
+		client:    asynq.NewClient(redisOpt),
+		opts:      opts,
+		keyPrefix: defaultWorkflowKeyPrefix,
+		ttl:       defaultWorkflowTTL,
+		stages:    make([][]WorkflowStep, 0),
+	}, nil
+}
+
+// Workflow is chain and fan-out/fan-in of task types
+type Workflow struct {
+	name      string
+	redis     redis.UniversalClient
+	client    *asynq.Client
+	opts      []asynq.Option
+	keyPrefix string
+	ttl       time.Duration
+	stages    [][]WorkflowStep
+	mids      []asynq.MiddlewareFunc
+	onFailure WorkflowFailureFunc
+}
+
+// Then append a stage, multiple steps run in parallel.
+//
+// Then panics if a task type is used by more than one step, since state and task ID of step are keyed by type.
+func (w *Workflow) Then(steps ...WorkflowStep) *Workflow {
+	for i := range steps {
+		if steps[i].Type == w.compensateType() || w.hasStep(steps[i].Type) || hasStepBefore(steps, i) {
+			panic(fmt.Sprintf("workflow %s: duplicate step %s", w.name, steps[i].Type))
+		}
+	}
+
+	if len(steps) > 0 {
+		w.stages = append(w.stages, steps)
+	}
+
+	return w
+}
+
+// Use append middlewares applied to every step inside failure detection of workflow
+func (w *Workflow) Use(mids ...asynq.MiddlewareFunc) *Workflow {
+	w.mids = append(w.mids, mids...)
+	return w
+}
+
+// OnFailure set function called after compensations while any step is archived
+func (w *Workflow) OnFailure(fn WorkflowFailureFunc) *Workflow {
+	w.onFailure = fn
+	return w
+}
+
+// TTL set expiration of workflow state in redis, default is 7 days
+func (w *Workflow) TTL(ttl time.Duration) *Workflow {
+	if ttl > 0 {
+		w.ttl = ttl
+	}
+
+	return w
+}
+
+// Register handlers of steps and compensation into mux
+func (w *Workflow) Register(mux *asynq.ServeMux) {
+	for i := range w.stages {
+		for j := range w.stages[i] {
+			mux.Handle(w.stages[i][j].Type, w.stepHandler(i, w.stages[i][j]))
+		}
+	}
+
+	mux.HandleFunc(w.compensateType(), w.compensate)
+}
+
+// Start store input and enqueue first stage, returns ID of workflow
+func (w *Workflow) Start(ctx context.Context, input []byte) (string, error) {
+	if len(w.stages) < 1 {
+		return "", errors.New("workflow has no steps")
+	}
+
+	id := xid.New().String()
+
+	ctx, span := GetTracer(ctx).Start(ctx, fmt.Sprintf("workflow %s", w.name),
+		oteltrace.WithSpanKind(oteltrace.SpanKindProducer),
+		oteltrace.WithAttributes(
+			attribute.String("asynq.workflow.name", w.name),
+			attribute.String("asynq.workflow.id", id)))
+	defer span.End()
+
+	key := w.key(id)
+	pipe := w.redis.TxPipeline()
+	pipe.HSet(ctx, key, "input", input)
+	pipe.Expire(ctx, key, w.ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		span.RecordError(err)
+		return "", err
+	}
+
+	if err := w.enqueueStage(ctx, id, 0); err != nil {
+		span.RecordError(err)
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Close clients
+func (w *Workflow) Close() error {
+	if err := w.client.Close(); err != nil {
+		return err
+	}
+
+	return w.redis.Close()
+}
+
+func (w *Workflow) stepHandler(stage int, step WorkflowStep) asynq.Handler {
+	var h asynq.Handler = asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		id := workflowIdOf(t)
+
+		span := GetSpan(ctx)
+		span.SetAttributes(
+			attribute.String("asynq.workflow.name", w.name),
+			attribute.String("asynq.workflow.id", id),
+			attribute.Int("asynq.workflow.stage", stage))
+
+		wf, err := w.load(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		res, err := step.Run(ctx, wf)
+		if err != nil {
+			return err
+		}
+
+		return w.complete(ctx, id, stage, step.Type, res)
+	})
+
+	for i := len(w.mids) - 1; i >= 0; i-- {
+		h = w.mids[i](h)
+	}
+
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) (err error) {
+		p := &workflowPayload{}
+		if err := json.Unmarshal(t.Payload(), p); err != nil {
+			return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+		}
+
+		defer func() {
+			if recv := recover(); recv != nil {
+				err = &PanicError{Value: recv, Stack: string(debug.Stack())}
+			}
+
+			if isFinalAttempt(ctx, err) {
+				w.fail(ctx, p.Workflow.Id, stage, step.Type, err)
+			}
+		}()
+
+		return h.ProcessTask(ctx, t)
+	})
+}
+
+// markStepDoneScript mark step as done once and returns number of completed steps in stage
+var markStepDoneScript = redis.NewScript(`
+if redis.call("HSETNX", KEYS[1], "done:" .. ARGV[1], 1) == 1 then
+	redis.call("HINCRBY", KEYS[1], "stage:" .. ARGV[2], 1)
+end
+return tonumber(redis.call("HGET", KEYS[1], "stage:" .. ARGV[2]))
+`)
+
+// complete store result and enqueue next stage once every step of current stage completed
+func (w *Workflow) complete(ctx context.Context, id string, stage int, step string, res []byte) error {
+	key := w.key(id)
+
+	if err := w.redis.HSet(ctx, key, "result:"+step, res).Err(); err != nil {
+		return err
+	}
+
+	done, err := markStepDoneScript.Run(ctx, w.redis, []string{key}, step, stage).Int()
+	if err != nil {
+		return err
+	}
+
+	if done < len(w.stages[stage]) {
+		return nil
+	}
+
+	if stage+1 >= len(w.stages) {
+		GetSpan(ctx).AddEvent("workflow_completed", oteltrace.WithAttributes(
+			attribute.String("asynq.workflow.id", id)))
+		return nil
+	}
+
+	// retried step enqueues next stage again, duplicates are dropped with deterministic task ID
+	return w.enqueueStage(ctx, id, stage+1)
+}
+
+// fail enqueue compensation once for the first archived step
+func (w *Workflow) fail(ctx context.Context, id string, stage int, step string, cause error) {
+	span := GetSpan(ctx)
+
+	ok, err := w.redis.HSetNX(ctx, w.key(id), "failed", step).Result()
+	if err != nil || !ok {
+		return
+	}
+	w.redis.HSet(ctx, w.key(id), "error", cause.Error())
+	w.redis.Expire(ctx, w.key(id), w.ttl)
+
+	span.AddEvent("workflow_failed", oteltrace.WithAttributes(
+		attribute.String("asynq.workflow.id", id),
+		attribute.String("asynq.workflow.step", step)))
+
+	if err := w.enqueue(ctx, w.compensateType(), id, stage, id+":compensate"); err != nil {
+		span.RecordError(err)
+	}
+}
+
+// compensate undo completed steps in reverse order, then call OnFailure
+func (w *Workflow) compensate(ctx context.Context, t *asynq.Task) error {
+	p := &workflowPayload{}
+	if err := json.Unmarshal(t.Payload(), p); err != nil {
+		return fmt.Errorf("json.Unmarshal failed: %v: %w", err, asynq.SkipRetry)
+	}
+
+	id := p.Workflow.Id
+	key := w.key(id)
+
+	state, err := w.redis.HGetAll(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	wf, err := w.load(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	span := GetSpan(ctx)
+	span.SetAttributes(
+		attribute.String("asynq.workflow.name", w.name),
+		attribute.String("asynq.workflow.id", id),
+		attribute.String("asynq.workflow.failedStep", state["failed"]))
+
+	for i := len(w.stages) - 1; i >= 0; i-- {
+		for _, step := range w.stages[i] {
+			if step.Compensate == nil || len(state["done:"+step.Type]) < 1 || len(state["compensated:"+step.Type]) > 0 {
+				continue
+			}
+
+			if err := step.Compensate(ctx, wf); err != nil {
+				return fmt.Errorf("compensate %s failed: %w", step.Type, err)
+			}
+
+			span.AddEvent("workflow_compensated", oteltrace.WithAttributes(
+				attribute.String("asynq.workflow.step", step.Type)))
+			w.redis.HSet(ctx, key, "compensated:"+step.Type, 1)
+		}
+	}
+
+	if w.onFailure != nil {
+		return w.onFailure(ctx, wf, state["failed"], state["error"])
+	}
+
+	return nil
+}
+
+func (w *Workflow) enqueueStage(ctx context.Context, id string, stage int) error {
+	for _, step := range w.stages[stage] {
+		if err := w.enqueue(ctx, step.Type, id, stage, id+":"+step.Type); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Workflow) enqueue(ctx context.Context, typeName, id string, stage int, taskId string) error {
+	p := &workflowPayload{}
+	p.Workflow.Name = w.name
+	p.Workflow.Id = id
+	p.Workflow.Stage = stage
+
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	opts := append([]asynq.Option{asynq.TaskID(taskId)}, w.opts...)
+	task, err := NewTracedTask(ctx, typeName, raw, opts...)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.client.EnqueueContext(ctx, task); err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return err
+	}
+
+	return nil
+}
+
+func (w *Workflow) load(ctx context.Context, id string) (*WorkflowContext, error) {
+	state, err := w.redis.HGetAll(ctx, w.key(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(state) < 1 {
+		return nil, fmt.Errorf("workflow %s not found: %w", id, asynq.SkipRetry)
+	}
+
+	res := &WorkflowContext{
+		Name:    w.name,
+		Id:      id,
+		Input:   []byte(state["input"]),
+		Results: map[string][]byte{},
+	}
+
+	for k, v := range state {
+		if strings.HasPrefix(k, "result:") {
+			res.Results[strings.TrimPrefix(k, "result:")] = []byte(v)
+		}
+	}
+
+	return res, nil
+}
+
+func (w *Workflow) hasStep(typeName string) bool {
+	for i := range w.stages {
+		for j := range w.stages[i] {
+			if w.stages[i][j].Type == typeName {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// hasStepBefore returns true if type of steps[i] is used by steps before i
+func hasStepBefore(steps []WorkflowStep, i int) bool {
+	for j := 0; j < i; j++ {
+		if steps[j].Type == steps[i].Type {
+			return true
+		}
+	}
+
+	return false
+}
+
+// workflowIdOf returns workflow ID in payload, empty string if payload is not decodable
+func workflowIdOf(t *asynq.Task) string {
+	p := &workflowPayload{}
+	json.Unmarshal(t.Payload(), p)
+	return p.Workflow.Id
+}
+
+func (w *Workflow) key(id string) string {
+	return w.keyPrefix + w.name + ":" + id
+}
+
+func (w *Workflow) compensateType() string {
+	return w.name + ":compensate"
+}
@@ -0,0 +1,116 @@
+package rkasynq
+
+import (
+	"context"
+	"errors"
+	"github.com/hibiken/asynq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newTestWorkflow(t *testing.T) (*Workflow, *asynq.Inspector) {
+	_, opt, _ := newTestRedis(t)
+
+	wf, err := NewWorkflow("order", opt)
+	assert.Nil(t, err)
+	t.Cleanup(func() { wf.Close() })
+
+	inspector := asynq.NewInspector(opt)
+	t.Cleanup(func() { inspector.Close() })
+
+	return wf, inspector
+}
+
+func TestWorkflow_ThenDuplicateStep(t *testing.T) {
+	wf, _ := newTestWorkflow(t)
+	run := func(ctx context.Context, wf *WorkflowContext) ([]byte, error) { return nil, nil }
+
+	wf.Then(WorkflowStep{Type: "order:charge", Run: run})
+
+	assert.Panics(t, func() { wf.Then(WorkflowStep{Type: "order:charge", Run: run}) })
+	assert.Panics(t, func() {
+		wf.Then(WorkflowStep{Type: "notify:email", Run: run}, WorkflowStep{Type: "notify:email", Run: run})
+	})
+	assert.Panics(t, func() { wf.Then(WorkflowStep{Type: wf.compensateType(), Run: run}) })
+	assert.Len(t, wf.stages, 1)
+}
+
+func TestWorkflow_FinalAttemptCompensates(t *testing.T) {
+	errInner := errors.New("inner")
+
+	cases := map[string]struct {
+		run  WorkflowStepFunc
+		mids []asynq.MiddlewareFunc
+	}{
+		"panic": {
+			run: func(ctx context.Context, wf *WorkflowContext) ([]byte, error) { panic("boom") },
+		},
+		"middleware": {
+			run: func(ctx context.Context, wf *WorkflowContext) ([]byte, error) { return nil, errInner },
+			mids: []asynq.MiddlewareFunc{func(h asynq.Handler) asynq.Handler {
+				return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+					h.ProcessTask(ctx, t)
+					return asynq.SkipRetry
+				})
+			}},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			wf, inspector := newTestWorkflow(t)
+			wf.Then(WorkflowStep{Type: "order:charge", Run: c.run}).Use(c.mids...)
+
+			mux := asynq.NewServeMux()
+			wf.Register(mux)
+
+			ctx := context.Background()
+			id, err := wf.Start(ctx, []byte("input"))
+			assert.Nil(t, err)
+
+			task, err := inspector.GetTaskInfo("default", id+":order:charge")
+			assert.Nil(t, err)
+
+			// no retry count in context, which is the final attempt
+			err = mux.ProcessTask(ctx, asynq.NewTask(task.Type, task.Payload))
+			assert.NotNil(t, err)
+			if name == "panic" {
+				assert.True(t, IsPanic(err))
+			}
+
+			failed, err := wf.redis.HGet(ctx, wf.key(id), "failed").Result()
+			assert.Nil(t, err)
+			assert.Equal(t, "order:charge", failed)
+
+			_, err = inspector.GetTaskInfo("default", id+":compensate")
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestWorkflow_LoadErrorCompensates(t *testing.T) {
+	wf, inspector := newTestWorkflow(t)
+	wf.Then(WorkflowStep{Type: "order:charge", Run: func(ctx context.Context, wf *WorkflowContext) ([]byte, error) {
+		return nil, nil
+	}})
+
+	mux := asynq.NewServeMux()
+	wf.Register(mux)
+
+	ctx := context.Background()
+	id, err := wf.Start(ctx, []byte("input"))
+	assert.Nil(t, err)
+
+	task, err := inspector.GetTaskInfo("default", id+":order:charge")
+	assert.Nil(t, err)
+
+	// state expired
+	assert.Nil(t, wf.redis.Del(ctx, wf.key(id)).Err())
+
+	err = mux.ProcessTask(ctx, asynq.NewTask(task.Type, task.Payload))
+	assert.True(t, errors.Is(err, asynq.SkipRetry))
+
+	_, err = inspector.GetTaskInfo("default", id+":compensate")
+	assert.Nil(t, err)
+	assert.True(t, wf.redis.TTL(ctx, wf.key(id)).Val() > 0)
+}